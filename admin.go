@@ -0,0 +1,519 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+var (
+	instancesMu sync.Mutex
+	instances   []*SlicerVM
+)
+
+// registerInstance makes a provisioned handler reachable from the admin API.
+func registerInstance(rs *SlicerVM) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	instances = append(instances, rs)
+}
+
+// unregisterInstance removes a handler from the admin API on cleanup.
+func unregisterInstance(rs *SlicerVM) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	for i, other := range instances {
+		if other == rs {
+			instances = append(instances[:i], instances[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshotInstances returns the currently registered handlers.
+func snapshotInstances() []*SlicerVM {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	return append([]*SlicerVM(nil), instances...)
+}
+
+// adminAPI exposes runtime controls for relight_slicervm handlers on
+// Caddy's admin endpoint.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.relight_slicervm",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/slicervm/prewarm", Handler: caddy.AdminHandlerFunc(a.handlePrewarm)},
+		{Pattern: "/slicervm/maintenance", Handler: caddy.AdminHandlerFunc(a.handleMaintenance)},
+		{Pattern: "/slicervm/apps/", Handler: caddy.AdminHandlerFunc(a.handleApps)},
+		{Pattern: "/slicervm/config", Handler: caddy.AdminHandlerFunc(a.handleConfig)},
+		{Pattern: "/slicervm/state", Handler: caddy.AdminHandlerFunc(a.handleState)},
+		{Pattern: "/slicervm/refresh", Handler: caddy.AdminHandlerFunc(a.handleRefresh)},
+		{Pattern: "/slicervm/health", Handler: caddy.AdminHandlerFunc(a.handleHealth)},
+	}
+}
+
+// Prewarm outcomes reported per app.
+const (
+	prewarmWarm      = "warm"
+	prewarmColdStart = "cold_start"
+	prewarmFailed    = "failed"
+)
+
+// prewarmResult is the per-app outcome of a bulk prewarm.
+type prewarmResult struct {
+	App    string `json:"app"`
+	Result string `json:"result"`
+	WakeMs int64  `json:"wake_ms"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handlePrewarm wakes a list of apps in parallel and reports, per app,
+// whether it was already warm, cold-started or failed, with wake latency.
+//
+//	POST /slicervm/prewarm
+//	{"apps": ["myapp", "reporting"]}
+func (adminAPI) handlePrewarm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	var req struct {
+		Apps []string `json:"apps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %w", err)}
+	}
+	if len(req.Apps) == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("no apps given")}
+	}
+
+	results := make([]prewarmResult, len(req.Apps))
+	var wg sync.WaitGroup
+	for i, app := range req.Apps {
+		wg.Add(1)
+		go func(i int, app string) {
+			defer wg.Done()
+			results[i] = prewarmApp(r.Context(), app)
+		}(i, app)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// prewarmApp wakes app through the first handler instance that knows it.
+func prewarmApp(ctx context.Context, app string) prewarmResult {
+	res := prewarmResult{App: app, Result: prewarmFailed}
+
+	for _, rs := range snapshotInstances() {
+		_, running, err := rs.stateMgr.runningIP(ctx, app)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if running {
+			res.Result = prewarmWarm
+			return res
+		}
+
+		start := time.Now()
+		_, err = rs.stateMgr.ensureRunning(ctx, app, time.Duration(rs.WakeTimeout))
+		res.WakeMs = time.Since(start).Milliseconds()
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		rs.stateMgr.touchLastSeen(app)
+		res.Result = prewarmColdStart
+		return res
+	}
+
+	res.Error = fmt.Sprintf("app %q: not found", app)
+	return res
+}
+
+// handleMaintenance reports or toggles maintenance mode for every
+// relight_slicervm handler. Without apps or host_groups it toggles global
+// maintenance; with them it toggles only those apps and host groups, which
+// are answered with message (default: the maintenance message). The Slicer
+// connection is left intact, so turning it off resumes normal waking and
+// pausing immediately.
+//
+//	GET  /slicervm/maintenance
+//	POST /slicervm/maintenance {"enabled": true}
+//	POST /slicervm/maintenance {"enabled": true, "apps": ["myapp"], "message": "upgrading"}
+//	POST /slicervm/maintenance {"enabled": false, "host_groups": ["apps"]}
+func (adminAPI) handleMaintenance(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req struct {
+			Enabled    bool     `json:"enabled"`
+			Apps       []string `json:"apps"`
+			HostGroups []string `json:"host_groups"`
+			Message    string   `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %w", err)}
+		}
+		for i, app := range req.Apps {
+			req.Apps[i] = normalizeHostname(app)
+		}
+		for _, rs := range snapshotInstances() {
+			if len(req.Apps) == 0 && len(req.HostGroups) == 0 {
+				rs.maintenance.Store(req.Enabled)
+				rs.logger.Info("maintenance mode changed", zap.Bool("enabled", req.Enabled))
+				continue
+			}
+			msg := req.Message
+			if msg == "" {
+				msg = rs.MaintenanceMessage
+			}
+			rs.scopedMaintenance.set(req.Apps, req.HostGroups, req.Enabled, msg)
+			rs.logger.Info("maintenance mode changed",
+				zap.Bool("enabled", req.Enabled),
+				zap.Strings("apps", req.Apps),
+				zap.Strings("host_groups", req.HostGroups),
+			)
+		}
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	var resp struct {
+		Enabled    bool     `json:"enabled"`
+		Apps       []string `json:"apps,omitempty"`
+		HostGroups []string `json:"host_groups,omitempty"`
+	}
+	for _, rs := range snapshotInstances() {
+		resp.Enabled = resp.Enabled || rs.maintenance.Load()
+		apps, groups := rs.scopedMaintenance.list()
+		resp.Apps = append(resp.Apps, apps...)
+		resp.HostGroups = append(resp.HostGroups, groups...)
+	}
+	slices.Sort(resp.Apps)
+	resp.Apps = slices.Compact(resp.Apps)
+	slices.Sort(resp.HostGroups)
+	resp.HostGroups = slices.Compact(resp.HostGroups)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// redacted replaces credentials in the effective configuration.
+const redacted = "[REDACTED]"
+
+// handleConfig returns the effective configuration of every handler, with
+// defaults filled in and runtime state such as maintenance mode applied.
+// Credentials are redacted; see redactConfig.
+//
+//	GET /slicervm/config
+func (adminAPI) handleConfig(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	configs := []SlicerVM{}
+	for _, rs := range snapshotInstances() {
+		cfg := *rs
+		redactConfig(&cfg)
+		cfg.Maintenance = rs.maintenance.Load()
+		configs = append(configs, cfg)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(configs)
+}
+
+// redactConfig replaces every credential-bearing field of cfg, a copy of a
+// handler's configuration:
+//
+//   - the Slicer token
+//   - the Slicer URL if it came from storage; otherwise only its userinfo,
+//     which is stripped
+//   - the expected readiness header value
+//   - the ask TLS key path
+//   - warmup request query strings
+//   - wake_bypass matcher values, which may match on credentials such as an
+//     Authorization header; the matcher names are kept
+func redactConfig(cfg *SlicerVM) {
+	if cfg.SlicerToken != "" {
+		cfg.SlicerToken = redacted
+	}
+	if strings.HasPrefix(cfg.SlicerURL, storageValuePrefix) {
+		cfg.SlicerURL = redacted
+	} else if u, err := url.Parse(cfg.SlicerURL); err == nil && u.User != nil {
+		u.User = nil
+		cfg.SlicerURL = u.String()
+	}
+	if cfg.ReadyCheckHeaderValue != "" {
+		cfg.ReadyCheckHeaderValue = redacted
+	}
+	if cfg.AskTLSKey != "" {
+		cfg.AskTLSKey = redacted
+	}
+	// Copied rather than edited in place: the map is shared with the handler.
+	if len(cfg.WarmupRequests) > 0 {
+		warmups := make(map[string][]string, len(cfg.WarmupRequests))
+		for app, paths := range cfg.WarmupRequests {
+			for _, path := range paths {
+				if p, query, ok := strings.Cut(path, "?"); ok && query != "" {
+					path = p + "?" + redacted
+				}
+				warmups[app] = append(warmups[app], path)
+			}
+		}
+		cfg.WarmupRequests = warmups
+	}
+	if len(cfg.WakeBypassRaw) > 0 {
+		value, _ := json.Marshal(redacted)
+		sets := make(caddyhttp.RawMatcherSets, len(cfg.WakeBypassRaw))
+		for i, set := range cfg.WakeBypassRaw {
+			sets[i] = make(caddy.ModuleMap, len(set))
+			for name := range set {
+				sets[i][name] = value
+			}
+		}
+		cfg.WakeBypassRaw = sets
+	}
+}
+
+// handleState returns the cached state of every app known to any handler:
+// hostname, IP, status, when it last served a request, how many requests and
+// cold starts it has served and its last wake error. It reads only the
+// cache and never calls Slicer.
+//
+//	GET /slicervm/state
+func (adminAPI) handleState(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	states := []vmState{}
+	for _, rs := range snapshotInstances() {
+		states = append(states, rs.stateMgr.snapshot()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(states)
+}
+
+// handleRefresh fetches every handler's host group nodes from Slicer and
+// reconciles the cached apps against them, e.g. after VMs were added or
+// removed, without reloading Caddy. A handler that fails is reported in its
+// result, so one unreachable group does not hide what the others changed.
+//
+//	POST /slicervm/refresh
+func (adminAPI) handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	results := []refreshResult{}
+	for _, rs := range snapshotInstances() {
+		res, err := rs.stateMgr.refreshGroup(r.Context())
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handleHealth reports whether every handler can reach Slicer, from the
+// check each idle watcher runs per sweep: 200 if so, 503 otherwise, so load
+// balancers can keep traffic away from an instance that cannot wake VMs.
+//
+//	GET /slicervm/health
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	checks := []slicerHealth{}
+	healthy := true
+	for _, rs := range snapshotInstances() {
+		h := rs.stateMgr.healthStatus()
+		healthy = healthy && h.Reachable
+		checks = append(checks, h)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(checks)
+}
+
+// handleApps serves per-app endpoints under /slicervm/apps/{app}/.
+func (adminAPI) handleApps(w http.ResponseWriter, r *http.Request) error {
+	app, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/slicervm/apps/"), "/")
+	if app == "" {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("not found")}
+	}
+
+	method := http.MethodGet
+	if action == "pause" || action == "resume" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	switch action {
+	case "ready":
+		return handleAppReady(w, r, app)
+	case "history":
+		return handleAppHistory(w, app)
+	case "pause", "resume":
+		return handleAppControl(w, r, app, action)
+	}
+	return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("not found")}
+}
+
+// appControlResult is the response of the manual pause and resume
+// endpoints.
+type appControlResult struct {
+	App    string   `json:"app"`
+	Status vmStatus `json:"status"`
+}
+
+// handleAppControl pauses or resumes app on demand, e.g. to warm it before
+// a scheduled event or drain it for maintenance, and reports its resulting
+// status. A resume joins any wake already in progress for the app and
+// counts as activity, so the idle watcher does not pause it straight away.
+//
+//	POST /slicervm/apps/{app}/pause
+//	POST /slicervm/apps/{app}/resume
+func handleAppControl(w http.ResponseWriter, r *http.Request, app, action string) error {
+	for _, rs := range snapshotInstances() {
+		_, _, err := rs.stateMgr.runningIP(r.Context(), app)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+		}
+		if rs.maintenance.Load() {
+			return caddy.APIError{HTTPStatus: http.StatusServiceUnavailable, Err: errMaintenance}
+		}
+
+		if action == "resume" {
+			_, err = rs.stateMgr.ensureRunning(r.Context(), app, time.Duration(rs.WakeTimeout))
+			if err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+			}
+			rs.stateMgr.touchLastSeen(app)
+		} else if !pauseApp(r.Context(), rs, app, "manual", -1) {
+			return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: fmt.Errorf("app %q: pause failed", app)}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(appControlResult{App: app, Status: rs.stateMgr.statusOf(app)})
+	}
+
+	return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("app %q: not found", app)}
+}
+
+// appReadiness is the response of the per-app readiness endpoint.
+type appReadiness struct {
+	App    string `json:"app"`
+	Ready  bool   `json:"ready"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleAppReady reports whether app is warm and, if a readiness probe is
+// configured, passing it: 200 if so, 503 otherwise. It reads only the cache,
+// never calling Slicer, waking the app or recording activity, so load
+// balancers can poll it freely. An app no handler has cached is reported
+// unknown with 503.
+//
+//	GET /slicervm/apps/{app}/ready
+func handleAppReady(w http.ResponseWriter, r *http.Request, app string) error {
+	notFound := false
+	for _, rs := range snapshotInstances() {
+		status, ip, ok := rs.stateMgr.cachedState(app)
+		if !ok {
+			continue
+		}
+		if status == statusNotFound {
+			notFound = true
+			continue
+		}
+
+		res := appReadiness{App: app, Ready: status == statusRunning, Status: status.String()}
+		if res.Ready && rs.stateMgr.probe != nil {
+			if err := rs.stateMgr.probe.check(r.Context(), rs.stateMgr.probeAddr(app, ip)); err != nil {
+				res.Ready = false
+				res.Error = err.Error()
+			}
+		}
+		return writeAppReadiness(w, res)
+	}
+
+	if notFound {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("app %q: not found", app)}
+	}
+	return writeAppReadiness(w, appReadiness{App: app, Status: statusUnknown.String()})
+}
+
+// writeAppReadiness writes res with 200 if the app is ready, 503 otherwise.
+func writeAppReadiness(w http.ResponseWriter, res appReadiness) error {
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(res)
+}
+
+// handleAppHistory returns the app's recent state transitions, oldest
+// first, from every handler that has seen it.
+//
+//	GET /slicervm/apps/{app}/history
+func handleAppHistory(w http.ResponseWriter, app string) error {
+	history := []stateTransition{}
+	found := false
+	for _, rs := range snapshotInstances() {
+		if h, ok := rs.stateMgr.history(app); ok {
+			found = true
+			history = append(history, h...)
+		}
+	}
+	if !found {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("app %q: no history", app)}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]any{"app": app, "history": history})
+}
@@ -2,9 +2,20 @@ package caddyrelightslicervm
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -24,62 +35,337 @@ import (
 type askServer struct {
 	listener net.Listener
 	server   *http.Server
-	stateMgr *vmStateManager
 	logger   *zap.Logger
+
+	// stateMgrs are the state managers of every handler sharing this
+	// server, guarded by askServersMu. A domain is approved if any of
+	// them has a VM for it.
+	stateMgrs []*vmStateManager
+
+	// slots bounds concurrent ask lookups; nil means unlimited.
+	slots chan struct{}
+
+	// negative remembers recently rejected domains so repeated asks for
+	// them don't reach Slicer. It is bounded so that probing random
+	// subdomains cannot exhaust memory; nil disables it.
+	negative *ttlLRU
+
+	// positive remembers recently approved domains, so a certificate
+	// storm for one domain costs one lookup per TTL; nil disables it.
+	positive *ttlLRU
+
+	// lookupTimeout bounds each ask's Slicer lookup.
+	lookupTimeout time.Duration
+
+	// prewake wakes approved domains in the background.
+	prewake bool
+
+	// opts are the options the server was started with.
+	opts askServerOptions
+}
+
+// askServerOptions hardens the ask server against slow or abusive clients.
+type askServerOptions struct {
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	maxConcurrent int
+	lookupTimeout time.Duration
+	prewake       bool
+
+	negativeCacheSize int
+	negativeCacheTTL  time.Duration
+	positiveCacheSize int
+	positiveCacheTTL  time.Duration
+
+	// tlsConfig, if set, serves the ask endpoint over HTTPS only. It is
+	// built afresh by every handler, so tlsCert and tlsKey identify it.
+	tlsConfig       *tls.Config
+	tlsCert, tlsKey string
+}
+
+// matches reports whether o and p configure the same server.
+func (o askServerOptions) matches(p askServerOptions) bool {
+	if (o.tlsConfig == nil) != (p.tlsConfig == nil) {
+		return false
+	}
+	o.tlsConfig, p.tlsConfig = nil, nil
+	return o == p
 }
 
-func newAskServer(addr string, stateMgr *vmStateManager, logger *zap.Logger) (*askServer, error) {
+var (
+	askServersMu sync.Mutex
+	askServers   = make(map[string]*askServer)
+)
+
+// acquireAskServer returns the ask server listening on addr, starting it
+// if needed, and adds stateMgr to the managers it consults. Handlers
+// sharing an address share one server, and a config reload hands the
+// server over to the new handlers instead of failing to bind the port the
+// old ones still hold. A handler whose options differ from the running
+// server's restarts it with its own, so a reload that changes them takes
+// effect; the managers already consulted carry over.
+func acquireAskServer(addr string, stateMgr *vmStateManager, logger *zap.Logger, opts askServerOptions) (*askServer, error) {
+	askServersMu.Lock()
+	defer askServersMu.Unlock()
+
+	if as, ok := askServers[addr]; ok {
+		if as.opts.matches(opts) {
+			as.stateMgrs = append(as.stateMgrs, stateMgr)
+			return as, nil
+		}
+		logger.Info("ask server options changed, restarting", zap.String("addr", addr))
+		delete(askServers, addr)
+		as.close()
+		next, err := newAskServer(addr, stateMgr, logger, opts)
+		if err != nil {
+			return nil, err
+		}
+		next.stateMgrs = append(as.stateMgrs, stateMgr)
+		askServers[addr] = next
+		return next, nil
+	}
+
+	as, err := newAskServer(addr, stateMgr, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	askServers[addr] = as
+	return as, nil
+}
+
+// releaseAskServer removes stateMgr from the managers the ask server on
+// addr consults and shuts the server down once no handler uses it.
+func releaseAskServer(addr string, stateMgr *vmStateManager) {
+	askServersMu.Lock()
+	as, ok := askServers[addr]
+	if !ok {
+		askServersMu.Unlock()
+		return
+	}
+	i := slices.Index(as.stateMgrs, stateMgr)
+	if i >= 0 {
+		as.stateMgrs = slices.Delete(as.stateMgrs, i, i+1)
+	}
+	last := i >= 0 && len(as.stateMgrs) == 0
+	if last {
+		delete(askServers, addr)
+	}
+	askServersMu.Unlock()
+
+	if last {
+		as.close()
+	}
+}
+
+func newAskServer(addr string, stateMgr *vmStateManager, logger *zap.Logger, opts askServerOptions) (*askServer, error) {
 	ln, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("ask server listen on %s: address already in use by another process", addr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("ask server listen on %s: %w", addr, err)
 	}
+	if opts.tlsConfig != nil {
+		ln = tls.NewListener(ln, opts.tlsConfig)
+	}
 
 	as := &askServer{
-		listener: ln,
-		stateMgr: stateMgr,
-		logger:   logger,
+		listener:  ln,
+		logger:    logger,
+		stateMgrs: []*vmStateManager{stateMgr},
+
+		lookupTimeout: opts.lookupTimeout,
+		prewake:       opts.prewake,
+		opts:          opts,
+	}
+	if opts.maxConcurrent > 0 {
+		as.slots = make(chan struct{}, opts.maxConcurrent)
+	}
+	if opts.negativeCacheSize > 0 && opts.negativeCacheTTL > 0 {
+		as.negative = newTTLLRU(opts.negativeCacheSize, opts.negativeCacheTTL)
+		as.negative.onEvict = func() {
+			slicerMetrics.askNegativeCache.WithLabelValues("eviction").Inc()
+		}
+	}
+	if opts.positiveCacheSize > 0 && opts.positiveCacheTTL > 0 {
+		as.positive = newTTLLRU(opts.positiveCacheSize, opts.positiveCacheTTL)
+		as.positive.onEvict = func() {
+			slicerMetrics.askPositiveCache.WithLabelValues("eviction").Inc()
+		}
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", as.handleAsk)
 
-	as.server = &http.Server{Handler: mux}
+	as.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: opts.readTimeout,
+		ReadTimeout:       opts.readTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+	}
 	go as.server.Serve(ln)
 
-	logger.Info("ask server started", zap.String("addr", ln.Addr().String()))
+	logger.Info("ask server started", zap.String("addr", ln.Addr().String()), zap.Bool("tls", opts.tlsConfig != nil))
 	return as, nil
 }
 
 func (as *askServer) handleAsk(w http.ResponseWriter, r *http.Request) {
-	domain := r.URL.Query().Get("domain")
+	domain := normalizeHostname(r.URL.Query().Get("domain"))
 	if domain == "" {
 		http.Error(w, "missing domain parameter", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	if as.negative != nil {
+		if as.negative.contains(domain) {
+			slicerMetrics.askNegativeCache.WithLabelValues("hit").Inc()
+			http.NotFound(w, r)
+			return
+		}
+		slicerMetrics.askNegativeCache.WithLabelValues("miss").Inc()
+	}
+
+	if as.positive != nil {
+		if as.positive.contains(domain) {
+			slicerMetrics.askPositiveCache.WithLabelValues("hit").Inc()
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		slicerMetrics.askPositiveCache.WithLabelValues("miss").Inc()
+	}
+
+	if as.slots != nil {
+		select {
+		case as.slots <- struct{}{}:
+			defer func() { <-as.slots }()
+		default:
+			as.logger.Warn("ask: too many concurrent requests", zap.String("domain", domain))
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), as.lookupTimeout)
 	defer cancel()
 
-	info, err := as.stateMgr.lookup(ctx, domain)
-	if err != nil {
+	askServersMu.Lock()
+	stateMgrs := slices.Clone(as.stateMgrs)
+	askServersMu.Unlock()
+
+	found := false
+	var owner *vmStateManager
+	var err error
+	for _, stateMgr := range stateMgrs {
+		info, lookupErr := stateMgr.lookup(ctx, domain)
+		if lookupErr != nil {
+			err = lookupErr
+			continue
+		}
+		if info.status != statusNotFound {
+			found = true
+			owner = stateMgr
+			break
+		}
+	}
+	if !found && err != nil {
 		as.logger.Error("ask lookup failed", zap.String("domain", domain), zap.Error(err))
 		http.Error(w, "lookup failed", http.StatusInternalServerError)
 		return
 	}
 
-	if info.status == statusNotFound {
+	if !found {
 		as.logger.Debug("ask: domain not found", zap.String("domain", domain))
+		if as.negative != nil {
+			// The bounded cache now holds the rejection; drop the state
+			// managers' unbounded not-found entries.
+			as.negative.add(domain)
+			for _, stateMgr := range stateMgrs {
+				stateMgr.forgetNotFound(domain)
+			}
+		}
 		http.NotFound(w, r)
 		return
 	}
 
 	as.logger.Info("ask: domain approved", zap.String("domain", domain))
+	if as.positive != nil {
+		as.positive.add(domain)
+	}
+	if as.prewake {
+		go as.prewakeDomain(owner, domain)
+	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "ok")
 }
 
+// prewakeDomain wakes domain's VM, if it is not already running, ahead of
+// the request its certificate is being issued for. The wake counts as
+// activity, so the VM idles out normally if no request follows.
+func (as *askServer) prewakeDomain(stateMgr *vmStateManager, domain string) {
+	timeout := stateMgr.wakeTimeout
+	ctx, cancel := context.WithTimeout(stateMgr.ctx, timeout)
+	defer cancel()
+
+	if _, err := stateMgr.ensureRunning(ctx, domain, timeout); err != nil {
+		as.logger.Warn("ask: prewake failed", zap.String("domain", domain), zap.Error(err))
+		return
+	}
+	stateMgr.touchLastSeen(domain)
+}
+
 func (as *askServer) close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	return as.server.Shutdown(ctx)
 }
+
+// askTLSConfig loads the ask server certificate from certFile and keyFile,
+// or, when both are empty, generates a self-signed one for localhost and
+// the host of addr. A self-signed certificate must be trusted by whatever
+// calls the ask endpoint.
+func askTLSConfig(certFile, keyFile, addr string) (*tls.Config, error) {
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading ask_tls certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ask_tls key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating ask_tls serial: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "relight_slicervm ask"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if ip == nil && host != "localhost" {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("generating ask_tls certificate: %w", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,64 @@
+package caddyrelightslicervm
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAcquireAskServerOptions(t *testing.T) {
+	const addr = "127.0.0.1:0"
+	opts := askServerOptions{readTimeout: time.Second, lookupTimeout: time.Second}
+	first, second, third := new(vmStateManager), new(vmStateManager), new(vmStateManager)
+
+	as, err := acquireAskServer(addr, first, zap.NewNop(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, m := range []*vmStateManager{first, second, third} {
+			releaseAskServer(addr, m)
+		}
+	})
+
+	same, err := acquireAskServer(addr, second, zap.NewNop(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != as {
+		t.Fatal("matching options started a second server")
+	}
+
+	opts.readTimeout = 2 * time.Second
+	opts.maxConcurrent = 8
+	next, err := acquireAskServer(addr, third, zap.NewNop(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == as {
+		t.Fatal("changed options reused the running server")
+	}
+	if next.server.ReadTimeout != 2*time.Second || cap(next.slots) != 8 {
+		t.Errorf("restarted server has read timeout %v, %d slots", next.server.ReadTimeout, cap(next.slots))
+	}
+	if len(next.stateMgrs) != 3 {
+		t.Errorf("restarted server consults %d managers, want 3", len(next.stateMgrs))
+	}
+
+	releaseAskServer(addr, first)
+	releaseAskServer(addr, second)
+	askServersMu.Lock()
+	_, running := askServers[addr]
+	askServersMu.Unlock()
+	if !running {
+		t.Fatal("server shut down while a handler still uses it")
+	}
+	releaseAskServer(addr, third)
+	askServersMu.Lock()
+	_, running = askServers[addr]
+	askServersMu.Unlock()
+	if running {
+		t.Fatal("server still registered after the last release")
+	}
+}
@@ -2,33 +2,143 @@ package caddyrelightslicervm
 
 import (
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
 	httpcaddyfile.RegisterHandlerDirective("relight_slicervm", parseCaddyfile)
 }
 
+// repeatableDirectives may be given more than once in a relight_slicervm
+// block, with each occurrence adding entries. Any other subdirective given
+// twice is an error rather than the last value silently winning.
+var repeatableDirectives = map[string]bool{
+	"host_group":          true,
+	"domain_suffix":       true,
+	"app_port_override":   true,
+	"upstream_target":     true, // per-app form only
+	"not_found":           true,
+	"wake_error":          true,
+	"alias":               true,
+	"reserved_name":       true,
+	"pause_after_request": true,
+	"prewarm":             true,
+	"schedule_wake":       true,
+	"warm_window":         true,
+	"warmup_requests":     true,
+	"wake_bypass":         true,
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 //
 //	relight_slicervm {
 //	    slicer_url     <url or socket path>
 //	    slicer_token   <token>
-//	    host_group     <name>
+//	    slicer_timeout <duration>
+//	    host_group     <name> [<domain_suffixes...>]
+//	    route_mode     host|path|subdomain_path
+//	    app_label_index <index>
+//	    domain_suffix  <suffixes...>
+//	    tag_match      auto|hostname
+//	    trust_forwarded_host
+//	    forward_client_ip
+//	    trust_forwarded_for
+//	    startup_check  [skip_permissions]
 //	    idle_timeout   <duration>
 //	    wake_timeout   <duration>
+//	    resume_timeout <duration>
+//	    fast_fail_after <duration>
+//	    retry_after    <duration> [adaptive]
 //	    app_port       <port>
+//	    app_port_override <app> <port>
 //	    watch_interval <duration>
+//	    watch_jitter   <fraction>|off
+//	    watch_dry_run
+//	    upstream_target ip|hostname [<apps...>]
+//	    upstream_stale_max <duration>
+//	    fallback_upstream <host:port>
+//	    upstream_var   <name>
+//	    upstream_scheme http|https [insecure]
+//	    upstream_proto http1|h2c|h2
+//	    wake_cooldown  <duration> [<max>]
+//	    wake_failure_threshold <n>
+//	    wake_node_concurrency <count>
+//	    max_concurrent_wakes <count>
+//	    min_replicas   <count>
+//	    load_balancing sticky|round_robin
+//	    wake_retries   <count> [<backoff>]
+//	    pause_timeout  <duration>
+//	    pause_concurrency <count>
+//	    pause_mode     pause|suspend
+//	    deep_idle_timeout <duration>
+//	    target_running <count>
+//	    pause_coalesce_window <duration>
+//	    max_running_lifetime <duration>
+//	    min_running_time <duration>
+//	    ready_check_path     <path>
+//	    ready_check_tcp
+//	    ready_check_port     <port>
+//	    ready_check_interval <duration>
+//	    ready_check_before_resume
+//	    ready_check_header   <name> [<value>]
+//	    idle_confirmations <count>
+//	    state_ttl      <duration>|off
+//	    state_history_size <count>
+//	    persist_state  <storage_key> [<max_age>]
+//	    shed_max_waking  <count>
+//	    shed_max_running <count>
+//	    ask_listen     <addr>
+//	    ask_tls        [<cert_file> <key_file>]
+//	    ask_read_timeout  <duration>
+//	    ask_write_timeout <duration>
+//	    ask_idle_timeout  <duration>
+//	    ask_max_concurrent <count>
+//	    ask_prewake
+//	    ask_negative_cache <size> [<ttl>]
+//	    ask_positive_cache <size> [<ttl>]
+//	    app_claim      <claim> [<header>]
+//	    cold_start_headers [<poll_interval>]
+//	    debug_headers
+//	    waiting_page   <file> | inline <template>
+//	    cold_start_redirect <url>
+//	    cold_start_buffer_limit <size>
+//	    max_buffered_body <size>
+//	    expect_continue early|defer
+//	    maintenance    [<message>]
+//	    not_found      <pattern> <status> [<location or body>]
+//	    wake_error     waking|failed|cooldown|shed <status> [<body>]
+//	    not_found_action error|passthrough
+//	    alias          <canonical> <aliases...>
+//	    reserved_name  <name> not_found|upstream <addr>|app <name>
+//	    pause_after_request <apps...>
+//	    prewarm        <apps...>
+//	    schedule_wake  <app> <cron> [<keep_warm>]
+//	    warm_window    <app> <days> <from>-<to> [<timezone>]
+//	    warmup_requests <app> <paths...>
+//	    metrics_per_app
+//	    wake_bypass {
+//	        <matchers...>
+//	    }
 //	}
 func (rs *SlicerVM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume directive name
 
+	seen := make(map[string]bool)
 	for d.NextBlock(0) {
+		if sub := d.Val(); !repeatableDirectives[sub] {
+			if seen[sub] {
+				return d.Errf("duplicate subdirective: %s", sub)
+			}
+			seen[sub] = true
+		}
+
 		switch d.Val() {
 		case "slicer_url":
 			if !d.NextArg() {
@@ -42,11 +152,72 @@ func (rs *SlicerVM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			rs.SlicerToken = d.Val()
 
+		case "slicer_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing slicer_timeout: %v", err)
+			}
+			rs.SlicerTimeout = caddy.Duration(dur)
+
 		case "host_group":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			group := args[0]
+			if rs.HostGroup == "" {
+				rs.HostGroup = group
+			} else {
+				rs.HostGroups = append(rs.HostGroups, group)
+			}
+			for _, suffix := range args[1:] {
+				if rs.HostGroupSuffixes == nil {
+					rs.HostGroupSuffixes = make(map[string]string)
+				}
+				if other, ok := rs.HostGroupSuffixes[suffix]; ok && other != group {
+					return d.Errf("domain suffix %s is mapped to host groups %s and %s", suffix, other, group)
+				}
+				rs.HostGroupSuffixes[suffix] = group
+			}
+
+		case "route_mode":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			rs.HostGroup = d.Val()
+			rs.RouteMode = d.Val()
+
+		case "app_label_index":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing app_label_index: %v", err)
+			}
+			rs.AppLabelIndex = n
+
+		case "domain_suffix":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			rs.DomainSuffixes = append(rs.DomainSuffixes, args...)
+
+		case "startup_check":
+			args := d.RemainingArgs()
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			rs.StartupCheck = true
+			if len(args) == 1 {
+				if args[0] != "skip_permissions" {
+					return d.Errf("unknown startup_check option: %s", args[0])
+				}
+				rs.StartupCheckSkipPermissions = true
+			}
 
 		case "idle_timeout":
 			if !d.NextArg() {
@@ -68,6 +239,38 @@ func (rs *SlicerVM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			rs.WakeTimeout = caddy.Duration(dur)
 
+		case "resume_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing resume_timeout: %v", err)
+			}
+			rs.ResumeTimeout = caddy.Duration(dur)
+
+		case "fast_fail_after":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing fast_fail_after: %v", err)
+			}
+			rs.FastFailAfter = caddy.Duration(dur)
+
+		case "retry_after":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "adaptive") {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("parsing retry_after: %v", err)
+			}
+			rs.RetryAfter = caddy.Duration(dur)
+			rs.RetryAfterAdaptive = len(args) == 2
+
 		case "app_port":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -78,6 +281,26 @@ func (rs *SlicerVM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			rs.AppPort = port
 
+		case "app_port_override":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			port, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing app_port_override: %v", err)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if rs.AppPorts == nil {
+				rs.AppPorts = make(map[string]int)
+			}
+			rs.AppPorts[app] = port
+
 		case "watch_interval":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -88,12 +311,716 @@ func (rs *SlicerVM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			rs.WatchInterval = caddy.Duration(dur)
 
+		case "upstream_target":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			target := d.Val()
+			apps := d.RemainingArgs()
+			if len(apps) == 0 {
+				if rs.UpstreamTarget != "" {
+					return d.Errf("duplicate subdirective: upstream_target")
+				}
+				rs.UpstreamTarget = target
+				break
+			}
+			if rs.AppUpstreamTargets == nil {
+				rs.AppUpstreamTargets = make(map[string]string)
+			}
+			for _, app := range apps {
+				if _, ok := rs.AppUpstreamTargets[app]; ok {
+					return d.Errf("duplicate upstream_target for %s", app)
+				}
+				rs.AppUpstreamTargets[app] = target
+			}
+
+		case "upstream_stale_max":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing upstream_stale_max: %v", err)
+			}
+			rs.UpstreamStaleMax = caddy.Duration(dur)
+
+		case "upstream_var":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.UpstreamVar = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "fallback_upstream":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.FallbackUpstream = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "upstream_proto":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.UpstreamProto = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "upstream_scheme":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "insecure") {
+				return d.ArgErr()
+			}
+			rs.UpstreamScheme = args[0]
+			rs.UpstreamTLSInsecure = len(args) == 2
+
+		case "pause_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing pause_timeout: %v", err)
+			}
+			rs.PauseTimeout = caddy.Duration(dur)
+
+		case "pause_concurrency":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing pause_concurrency: %v", err)
+			}
+			rs.PauseConcurrency = n
+
+		case "pause_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.PauseMode = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "deep_idle_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing deep_idle_timeout: %v", err)
+			}
+			rs.DeepIdleTimeout = caddy.Duration(dur)
+
+		case "target_running":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing target_running: %v", err)
+			}
+			rs.TargetRunning = n
+
+		case "pause_coalesce_window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing pause_coalesce_window: %v", err)
+			}
+			rs.PauseCoalesceWindow = caddy.Duration(dur)
+
+		case "max_running_lifetime":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_running_lifetime: %v", err)
+			}
+			rs.MaxRunningLifetime = caddy.Duration(dur)
+
+		case "min_running_time":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing min_running_time: %v", err)
+			}
+			rs.MinRunningTime = caddy.Duration(dur)
+
+		case "wake_cooldown":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("parsing wake_cooldown: %v", err)
+			}
+			rs.WakeCooldown = caddy.Duration(dur)
+			if len(args) == 2 {
+				dur, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing wake_cooldown max: %v", err)
+				}
+				rs.WakeCooldownMax = caddy.Duration(dur)
+			}
+
+		case "wake_failure_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing wake_failure_threshold: %v", err)
+			}
+			rs.WakeFailureThreshold = n
+
+		case "wake_node_concurrency":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing wake_node_concurrency: %v", err)
+			}
+			rs.WakeNodeConcurrency = n
+
+		case "max_concurrent_wakes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_concurrent_wakes: %v", err)
+			}
+			rs.MaxConcurrentWakes = n
+
+		case "min_replicas":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing min_replicas: %v", err)
+			}
+			rs.MinReplicas = n
+
+		case "tag_match":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.TagMatch = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "trust_forwarded_host":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.TrustForwardedHost = true
+
+		case "forward_client_ip":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.ForwardClientIP = true
+
+		case "trust_forwarded_for":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.TrustForwardedFor = true
+
+		case "load_balancing":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.LoadBalancing = d.Val()
+
+		case "wake_retries":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("parsing wake_retries: %v", err)
+			}
+			rs.WakeRetries = n
+			if len(args) == 2 {
+				dur, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing wake_retries backoff: %v", err)
+				}
+				rs.WakeRetryBackoff = caddy.Duration(dur)
+			}
+
+		case "ready_check_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.ReadyCheckPath = d.Val()
+
+		case "ready_check_tcp":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.ReadyCheckTCP = true
+
+		case "ready_check_port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			port, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing ready_check_port: %v", err)
+			}
+			rs.ReadyCheckPort = port
+
+		case "ready_check_before_resume":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.ReadyCheckBeforeResume = true
+
+		case "ready_check_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing ready_check_interval: %v", err)
+			}
+			rs.ReadyCheckInterval = caddy.Duration(dur)
+
+		case "ready_check_header":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			rs.ReadyCheckHeader = args[0]
+			if len(args) == 2 {
+				rs.ReadyCheckHeaderValue = args[1]
+			}
+
+		case "idle_confirmations":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing idle_confirmations: %v", err)
+			}
+			rs.IdleConfirmations = n
+
+		case "watch_jitter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				rs.WatchJitter = -1
+				break
+			}
+			f, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("parsing watch_jitter: %v", err)
+			}
+			rs.WatchJitter = f
+
+		case "watch_dry_run":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.WatchDryRun = true
+
+		case "state_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() == "off" {
+				rs.StateTTL = -1
+				break
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing state_ttl: %v", err)
+			}
+			rs.StateTTL = caddy.Duration(dur)
+
+		case "state_history_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing state_history_size: %v", err)
+			}
+			rs.StateHistorySize = n
+
+		case "persist_state":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			rs.PersistState = args[0]
+			if len(args) == 2 {
+				dur, err := time.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing persist_state max age: %v", err)
+				}
+				rs.PersistStateMaxAge = caddy.Duration(dur)
+			}
+
+		case "shed_max_waking", "shed_max_running":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s: %v", name, err)
+			}
+			if name == "shed_max_waking" {
+				rs.ShedMaxWaking = n
+			} else {
+				rs.ShedMaxRunning = n
+			}
+
 		case "ask_listen":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			rs.AskListenAddr = d.Val()
 
+		case "ask_tls":
+			args := d.RemainingArgs()
+			if len(args) != 0 && len(args) != 2 {
+				return d.ArgErr()
+			}
+			rs.AskTLS = true
+			if len(args) == 2 {
+				rs.AskTLSCert = args[0]
+				rs.AskTLSKey = args[1]
+			}
+
+		case "ask_read_timeout", "ask_write_timeout", "ask_idle_timeout":
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := time.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s: %v", name, err)
+			}
+			switch name {
+			case "ask_read_timeout":
+				rs.AskReadTimeout = caddy.Duration(dur)
+			case "ask_write_timeout":
+				rs.AskWriteTimeout = caddy.Duration(dur)
+			case "ask_idle_timeout":
+				rs.AskIdleTimeout = caddy.Duration(dur)
+			}
+
+		case "ask_negative_cache", "ask_positive_cache":
+			name := d.Val()
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("parsing %s size: %v", name, err)
+			}
+			var ttl time.Duration
+			if len(args) == 2 {
+				if ttl, err = time.ParseDuration(args[1]); err != nil {
+					return d.Errf("parsing %s ttl: %v", name, err)
+				}
+			}
+			switch name {
+			case "ask_negative_cache":
+				rs.AskNegativeCacheSize, rs.AskNegativeCacheTTL = n, caddy.Duration(ttl)
+			case "ask_positive_cache":
+				rs.AskPositiveCacheSize, rs.AskPositiveCacheTTL = n, caddy.Duration(ttl)
+			}
+
+		case "ask_max_concurrent":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("parsing ask_max_concurrent: %v", err)
+			}
+			rs.AskMaxConcurrent = n
+
+		case "ask_prewake":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.AskPrewake = true
+
+		case "app_claim":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			rs.AppClaim = args[0]
+			if len(args) == 2 {
+				rs.AppClaimHeader = args[1]
+			}
+
+		case "cold_start_headers":
+			args := d.RemainingArgs()
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			rs.ColdStartHeaders = true
+			if len(args) == 1 {
+				dur, err := time.ParseDuration(args[0])
+				if err != nil {
+					return d.Errf("parsing cold_start_headers poll interval: %v", err)
+				}
+				rs.ColdStartPollInterval = caddy.Duration(dur)
+			}
+
+		case "debug_headers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.DebugHeaders = true
+
+		case "waiting_page":
+			args := d.RemainingArgs()
+			switch {
+			case len(args) == 1:
+				rs.WaitingPage = args[0]
+			case len(args) == 2 && args[0] == "inline":
+				rs.WaitingPageTemplate = args[1]
+			default:
+				return d.ArgErr()
+			}
+
+		case "cold_start_redirect":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.ColdStartRedirect = d.Val()
+
+		case "cold_start_buffer_limit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("parsing cold_start_buffer_limit: %v", err)
+			}
+			rs.ColdStartBufferLimit = int64(size)
+
+		case "max_buffered_body":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("parsing max_buffered_body: %v", err)
+			}
+			rs.MaxBufferedBody = int64(size)
+
+		case "expect_continue":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.ExpectContinue = d.Val()
+
+		case "maintenance":
+			args := d.RemainingArgs()
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			rs.Maintenance = true
+			if len(args) == 1 {
+				rs.MaintenanceMessage = args[0]
+			}
+
+		case "not_found_action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.NotFoundAction = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "not_found":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			code, err := strconv.Atoi(args[1])
+			if err != nil {
+				return d.Errf("parsing not_found status: %v", err)
+			}
+			rule := &NotFoundRule{Pattern: args[0], StatusCode: code}
+			if len(args) == 3 {
+				if code >= 300 && code < 400 {
+					rule.Location = args[2]
+				} else {
+					rule.Body = args[2]
+				}
+			}
+			rs.NotFoundRules = append(rs.NotFoundRules, rule)
+
+		case "wake_error":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			code, err := strconv.Atoi(args[1])
+			if err != nil {
+				return d.Errf("parsing wake_error status: %v", err)
+			}
+			if rs.WakeErrors == nil {
+				rs.WakeErrors = make(map[string]*WakeErrorResponse)
+			}
+			if _, ok := rs.WakeErrors[args[0]]; ok {
+				return d.Errf("duplicate wake_error for %s", args[0])
+			}
+			resp := &WakeErrorResponse{StatusCode: code}
+			if len(args) == 3 {
+				resp.Body = args[2]
+			}
+			rs.WakeErrors[args[0]] = resp
+
+		case "alias":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if rs.Aliases == nil {
+				rs.Aliases = make(map[string]string)
+			}
+			for _, alias := range args[1:] {
+				if prev, ok := rs.Aliases[alias]; ok && prev != args[0] {
+					return d.Errf("alias %s already maps to %s", alias, prev)
+				}
+				rs.Aliases[alias] = args[0]
+			}
+
+		case "reserved_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rn := &ReservedName{Action: d.Val()}
+			switch rn.Action {
+			case reservedNotFound:
+			case reservedUpstream:
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rn.Upstream = d.Val()
+			case reservedApp:
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rn.App = d.Val()
+			default:
+				return d.Errf("unknown reserved_name action: %s", rn.Action)
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if rs.ReservedNames == nil {
+				rs.ReservedNames = make(map[string]*ReservedName)
+			}
+			if _, ok := rs.ReservedNames[name]; ok {
+				return d.Errf("duplicate reserved_name: %s", name)
+			}
+			rs.ReservedNames[name] = rn
+
+		case "pause_after_request":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			rs.PauseAfterRequest = append(rs.PauseAfterRequest, args...)
+
+		case "prewarm":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			rs.Prewarm = append(rs.Prewarm, args...)
+
+		case "schedule_wake":
+			args := d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			sw := &ScheduledWake{App: args[0], Cron: args[1]}
+			if len(args) == 3 {
+				dur, err := time.ParseDuration(args[2])
+				if err != nil {
+					return d.Errf("parsing schedule_wake keep_warm: %v", err)
+				}
+				sw.KeepWarm = caddy.Duration(dur)
+			}
+			rs.ScheduledWakes = append(rs.ScheduledWakes, sw)
+
+		case "warm_window":
+			args := d.RemainingArgs()
+			if len(args) < 3 || len(args) > 4 {
+				return d.ArgErr()
+			}
+			from, to, ok := strings.Cut(args[2], "-")
+			if !ok {
+				return d.Errf("parsing warm_window: want <from>-<to>, got %q", args[2])
+			}
+			w := &WarmWindow{App: args[0], Days: args[1], From: from, To: to}
+			if len(args) == 4 {
+				w.Timezone = args[3]
+			}
+			rs.WarmWindows = append(rs.WarmWindows, w)
+
+		case "metrics_per_app":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			rs.MetricsPerApp = true
+
+		case "warmup_requests":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if rs.WarmupRequests == nil {
+				rs.WarmupRequests = make(map[string][]string)
+			}
+			rs.WarmupRequests[args[0]] = append(rs.WarmupRequests[args[0]], args[1:]...)
+
+		case "wake_bypass":
+			matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
+			if err != nil {
+				return d.Errf("parsing wake_bypass: %v", err)
+			}
+			rs.WakeBypassRaw = append(rs.WakeBypassRaw, matcherSet)
+
 		default:
 			return d.Errf("unknown subdirective: %s", d.Val())
 		}
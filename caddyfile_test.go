@@ -0,0 +1,87 @@
+package caddyrelightslicervm
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// parseTestCaddyfile parses body as the contents of a relight_slicervm block.
+func parseTestCaddyfile(body string) (*SlicerVM, error) {
+	rs := new(SlicerVM)
+	err := rs.UnmarshalCaddyfile(caddyfile.NewTestDispenser("relight_slicervm {\n" + body + "\n}"))
+	return rs, err
+}
+
+func TestUnmarshalCaddyfileRepeatedMerged(t *testing.T) {
+	rs, err := parseTestCaddyfile(`
+		host_group apps
+		host_group batch
+		prewarm myapp
+		prewarm shop blog
+		pause_after_request cron
+		pause_after_request report
+		alias myapp shop.example.com
+		alias myapp promo
+		alias myapp shop.example.com
+		reserved_name www app marketing
+		reserved_name admin not_found
+		upstream_target hostname api
+		upstream_target ip web
+		wake_bypass {
+			path /healthz
+		}
+		wake_bypass {
+			header User-Agent Prometheus*
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.HostGroup != "apps" || !slices.Equal(rs.HostGroups, []string{"batch"}) {
+		t.Errorf("host groups = %q + %q", rs.HostGroup, rs.HostGroups)
+	}
+	if !slices.Equal(rs.Prewarm, []string{"myapp", "shop", "blog"}) {
+		t.Errorf("prewarm = %q", rs.Prewarm)
+	}
+	if !slices.Equal(rs.PauseAfterRequest, []string{"cron", "report"}) {
+		t.Errorf("pause_after_request = %q", rs.PauseAfterRequest)
+	}
+	if len(rs.Aliases) != 2 || rs.Aliases["shop.example.com"] != "myapp" || rs.Aliases["promo"] != "myapp" {
+		t.Errorf("aliases = %v", rs.Aliases)
+	}
+	if len(rs.ReservedNames) != 2 || rs.ReservedNames["www"] == nil || rs.ReservedNames["admin"] == nil {
+		t.Errorf("reserved names = %v", rs.ReservedNames)
+	}
+	if len(rs.AppUpstreamTargets) != 2 {
+		t.Errorf("per-app upstream targets = %v", rs.AppUpstreamTargets)
+	}
+	if len(rs.WakeBypassRaw) != 2 {
+		t.Errorf("wake_bypass blocks = %d, want 2 matcher sets", len(rs.WakeBypassRaw))
+	}
+}
+
+func TestUnmarshalCaddyfileRepeatedConflict(t *testing.T) {
+	tests := []struct {
+		name, body, wantErr string
+	}{
+		{"scalar", "idle_timeout 5m\nidle_timeout 10m", "duplicate subdirective: idle_timeout"},
+		{"scalar, same value", "slicer_url http://a\nslicer_url http://a", "duplicate subdirective: slicer_url"},
+		{"flag", "metrics_per_app\nmetrics_per_app", "duplicate subdirective: metrics_per_app"},
+		{"alias", "alias myapp shop\nalias blog shop", "alias shop already maps to myapp"},
+		{"reserved_name", "reserved_name www not_found\nreserved_name www app marketing", "duplicate reserved_name: www"},
+		{"upstream_target per app", "upstream_target hostname api\nupstream_target ip api", "duplicate upstream_target for api"},
+		{"upstream_target global", "upstream_target ip\nupstream_target hostname", "duplicate subdirective: upstream_target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestCaddyfile(tt.body)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,13 +3,21 @@ package caddyrelightslicervm
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	sdk "github.com/slicervm/sdk"
 	"go.uber.org/zap"
 )
@@ -19,42 +27,670 @@ import (
 // resuming them on incoming requests.
 type SlicerVM struct {
 	// SlicerURL is the Slicer API address. Can be an HTTP URL
-	// (e.g. http://127.0.0.1:8080) or a Unix socket path
-	// (e.g. ~/slicer-mac/slicer.sock or /var/run/slicer.sock).
+	// (e.g. http://127.0.0.1:8080) or a Unix socket, preferably as a
+	// unix:// URL (e.g. unix:///var/run/slicer.sock); a bare path such as
+	// ~/slicer-mac/slicer.sock is also accepted. Relative socket paths are
+	// resolved against Caddy's working directory.
+	// A value of the form "storage:<key>" is loaded from Caddy's
+	// configured storage at provision time.
 	SlicerURL string `json:"slicer_url"`
 
 	// SlicerToken is the API token for authenticating with Slicer.
+	// Like SlicerURL, it may be given as "storage:<key>".
 	SlicerToken string `json:"slicer_token"`
 
+	// SlicerTimeout bounds each call to the Slicer API, e.g. to allow for
+	// a slow link to a remote Slicer. It also replaces the 10s limit on
+	// startup checks, health checks and ask lookups. Default: 0 (calls are
+	// bounded by their callers alone).
+	SlicerTimeout caddy.Duration `json:"slicer_timeout,omitempty"`
+
 	// HostGroup is the Slicer host group containing app VMs.
 	// Apps are identified by node tags matching the subdomain.
 	HostGroup string `json:"host_group"`
 
+	// HostGroups are further host groups searched for apps, e.g. separate
+	// staging and production groups served by one handler. VMs in other
+	// groups are ignored once more than one group is configured.
+	HostGroups []string `json:"host_groups,omitempty"`
+
+	// HostGroupSuffixes maps domain suffixes to the host group searched for
+	// app names ending in them, e.g. ".staging.example.com" to "staging".
+	// The longest matching suffix wins; other names search every group.
+	HostGroupSuffixes map[string]string `json:"host_group_suffixes,omitempty"`
+
+	// StartupCheck makes Provision verify that Slicer is reachable, the
+	// host group exists and the token may pause and resume VMs, failing
+	// startup otherwise. Default: false.
+	StartupCheck bool `json:"startup_check,omitempty"`
+
+	// StartupCheckSkipPermissions limits StartupCheck to connectivity and
+	// the host group, skipping the pause/resume permission check.
+	StartupCheckSkipPermissions bool `json:"startup_check_skip_permissions,omitempty"`
+
+	// RouteMode selects how the app name is derived from a request. "host"
+	// (default) uses the hostname. "path" uses the first path segment, so
+	// example.com/myapp/... is app "myapp", for apps behind one hostname.
+	// "subdomain_path" combines the first hostname label with the first
+	// path segment, so a.example.com/svc1 is app "a/svc1" and is served by
+	// the VM tagged "a/svc1". In both path modes the segment is stripped
+	// from the path before proxying.
+	RouteMode string `json:"route_mode,omitempty"`
+
+	// AppLabelIndex, in route_mode host, selects the dot-separated label of
+	// the hostname that names the app, e.g. 1 for team.myapp.example.com.
+	// Requests whose hostname has too few labels get 400. Default: 0, which
+	// matches the full hostname first, then its first label.
+	AppLabelIndex int `json:"app_label_index,omitempty"`
+
+	// DomainSuffixes, in route_mode host, are the base domains apps are
+	// served under, e.g. "apps.example.com" or "localhost". The suffix is
+	// stripped and the leftmost remaining label names the app, so
+	// myapp.apps.example.com and myapp.localhost are both app "myapp".
+	// Requests for other hostnames get 400. Default: none (the hostname
+	// is matched as described for AppLabelIndex).
+	DomainSuffixes []string `json:"domain_suffixes,omitempty"`
+
+	// TagMatch selects how app names are matched against node tags. "auto"
+	// (default) tries the full name, then its first label. "hostname" only
+	// accepts a tag equal to the full name, for fleets whose tags are full
+	// hostnames and where shared first labels (api.a.com, api.b.com) must
+	// not fall through to a VM tagged with the label.
+	TagMatch string `json:"tag_match,omitempty"`
+
+	// TrustForwardedHost derives the app name from X-Forwarded-Host
+	// instead of Host, for requests from one of the server's
+	// trusted_proxies. Requests from other clients, or without the header,
+	// use Host as before. Off by default.
+	TrustForwardedHost bool `json:"trust_forwarded_host,omitempty"`
+
+	// ForwardClientIP sets X-Forwarded-For and X-Real-IP to the client's
+	// address before handing the request on, so the app inside the VM sees
+	// the real client whatever handler follows. Off by default.
+	ForwardClientIP bool `json:"forward_client_ip,omitempty"`
+
+	// TrustForwardedFor keeps an existing X-Forwarded-For on requests from
+	// one of the server's trusted_proxies, as sent, and takes X-Real-IP
+	// from its first entry; reverse_proxy appends the proxy's address.
+	// Requires ForwardClientIP.
+	TrustForwardedFor bool `json:"trust_forwarded_for,omitempty"`
+
 	// IdleTimeout is how long a VM can be idle before being paused.
 	// Default: 5m. Minimum: 30s.
 	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
 
 	// WakeTimeout is the maximum time to wait for a paused VM to resume.
-	// Default: 30s.
+	// Default: 30s. Maximum: 10m.
 	WakeTimeout caddy.Duration `json:"wake_timeout,omitempty"`
 
+	// ResumeTimeout bounds the Slicer resume call for each node, retries
+	// included, separately from how long requests wait for the app. It must
+	// not exceed WakeTimeout, which also covers the readiness probe.
+	// Default: WakeTimeout.
+	ResumeTimeout caddy.Duration `json:"resume_timeout,omitempty"`
+
+	// FastFailAfter, if shorter than WakeTimeout, is how long a request
+	// waits for a cold app before getting a 503. The wake carries on in
+	// the background, so a retry finds the app ready. Default: 0 (wait
+	// for the whole WakeTimeout).
+	FastFailAfter caddy.Duration `json:"fast_fail_after,omitempty"`
+
+	// RetryAfter is the Retry-After sent with the 503 for an app that is
+	// still starting up, rounded up to whole seconds. Default: 5s.
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+
+	// RetryAfterAdaptive sends the time the app's wakes have taken on
+	// average, less how long the current wake has run, instead of
+	// RetryAfter once the app has woken at least once.
+	RetryAfterAdaptive bool `json:"retry_after_adaptive,omitempty"`
+
 	// AppPort is the port on the VM to proxy to. Default: 8080.
 	AppPort int `json:"app_port,omitempty"`
 
+	// AppPorts overrides AppPort per app, keyed by app name or hostname,
+	// for apps that listen on a different port.
+	AppPorts map[string]int `json:"app_ports,omitempty"`
+
+	// UpstreamTarget selects what the upstream is built from: "ip" proxies
+	// to the IP reported by Slicer, "hostname" resolves the VM hostname
+	// through DNS on each request. Default: "ip".
+	UpstreamTarget string `json:"upstream_target,omitempty"`
+
+	// AppUpstreamTargets overrides UpstreamTarget per app, keyed by app
+	// name or hostname, for fleets where only some VMs have stable DNS.
+	AppUpstreamTargets map[string]string `json:"app_upstream_targets,omitempty"`
+
+	// UpstreamStaleMax, with upstream_target hostname, lets a request fall
+	// back to the last successfully resolved IP for up to this long when
+	// resolution fails. Default: 0 (no fallback).
+	UpstreamStaleMax caddy.Duration `json:"upstream_stale_max,omitempty"`
+
+	// FallbackUpstream is the upstream (host:port) requests are sent to
+	// instead when their VM's address has been reported unhealthy by a
+	// reverse_proxy health check, e.g. a status page service. Default: ""
+	// (proxy to the VM regardless).
+	FallbackUpstream string `json:"fallback_upstream,omitempty"`
+
+	// UpstreamVar is the name of the var the upstream is set in, for
+	// reverse_proxy to read as {http.vars.<name>}; <name>_scheme and
+	// <name>_url are set alongside it. Letters, digits and underscores
+	// only. Default: "relight_slicervm_upstream".
+	UpstreamVar string `json:"upstream_var,omitempty"`
+
+	// UpstreamScheme is the scheme apps serve on the app port: "http"
+	// (default) or "https". It is exposed to reverse_proxy as
+	// {http.vars.<upstream_var>_scheme}, and the module's own
+	// readiness probes and warmup requests use it.
+	UpstreamScheme string `json:"upstream_scheme,omitempty"`
+
+	// UpstreamTLSInsecure skips certificate verification for the module's
+	// own https requests to apps, for self-signed certificates. The
+	// reverse_proxy transport needs tls_insecure_skip_verify separately.
+	UpstreamTLSInsecure bool `json:"upstream_tls_insecure,omitempty"`
+
+	// UpstreamProto is the HTTP protocol apps speak on the app port:
+	// "http1" (default), "h2c" (HTTP/2 without TLS, e.g. for gRPC) or "h2"
+	// (HTTP/2 over TLS). It is exposed to reverse_proxy as
+	// {http.vars.<upstream_var>_proto}, and the module's own readiness
+	// probes and warmup requests use it.
+	UpstreamProto string `json:"upstream_proto,omitempty"`
+
 	// WatchInterval is how often the idle watcher checks for idle VMs.
-	// Default: 30s.
+	// Default: 30s. Minimum: 1s.
 	WatchInterval caddy.Duration `json:"watch_interval,omitempty"`
 
+	// WatchJitter randomises each watch interval by up to this fraction
+	// either way, so handlers reloaded together spread their pauses out
+	// rather than hitting Slicer at the same instant. Default: 0.1 (±10%);
+	// -1 ("off" in the Caddyfile) disables it.
+	WatchJitter float64 `json:"watch_jitter,omitempty"`
+
+	// WatchDryRun makes the idle watcher log the VMs it would pause,
+	// suspend or recycle without touching them, to tune IdleTimeout
+	// before enabling scale-to-zero. Default: false.
+	WatchDryRun bool `json:"watch_dry_run,omitempty"`
+
+	// WakeNodeConcurrency caps how many nodes of a multi-node app are
+	// resumed at once; the rest are staggered behind them. Requests are
+	// still released as soon as the first node is ready. Default: 4.
+	WakeNodeConcurrency int `json:"wake_node_concurrency,omitempty"`
+
+	// MaxConcurrentWakes caps how many apps are woken at once, protecting
+	// Slicer from a burst of cold requests. Further wakes queue for a free
+	// slot; their requests still give up after WakeTimeout. Default: 0 (no
+	// limit).
+	MaxConcurrentWakes int `json:"max_concurrent_wakes,omitempty"`
+
+	// MinReplicas is how many paused nodes of a multi-node app a wake
+	// resumes; the others stay paused as spares. Default: 0 (all nodes).
+	MinReplicas int `json:"min_replicas,omitempty"`
+
+	// LoadBalancing selects the node requests for a multi-node app go to.
+	// "sticky" (default) keeps them on one running node for as long as it
+	// stays up; "round_robin" rotates across every running node.
+	LoadBalancing string `json:"load_balancing,omitempty"`
+
+	// WakeRetries is how many times a resume that fails with a transient
+	// error (a Slicer 5xx or a connection failure) is retried before the
+	// wake fails. Retries stay within ResumeTimeout. Default: 2; -1 disables.
+	WakeRetries int `json:"wake_retries,omitempty"`
+
+	// WakeRetryBackoff is the base delay before the first retry. It doubles
+	// with each attempt, with full jitter. Default: 200ms.
+	WakeRetryBackoff caddy.Duration `json:"wake_retry_backoff,omitempty"`
+
+	// WakeCooldown is how long to refuse new wakes after an app fails to
+	// wake, doubling with each consecutive failure up to WakeCooldownMax,
+	// so a crash-looping app isn't hammered. Requests during the cooldown
+	// get a 503. The failure count resets once the app stays up for
+	// WakeCooldownMax. Default: 0 (disabled).
+	WakeCooldown caddy.Duration `json:"wake_cooldown,omitempty"`
+
+	// WakeCooldownMax caps the wake cooldown. Default: 5m.
+	WakeCooldownMax caddy.Duration `json:"wake_cooldown_max,omitempty"`
+
+	// WakeFailureThreshold is how many consecutive wakes must fail before
+	// WakeCooldown starts, so one flaky resume doesn't lock an app out.
+	// Default: 1.
+	WakeFailureThreshold int `json:"wake_failure_threshold,omitempty"`
+
+	// ShedMaxWaking refuses new wakes with a 503 while this many VMs are
+	// already waking. Requests to running apps are unaffected.
+	// Default: 0 (no limit).
+	ShedMaxWaking int `json:"shed_max_waking,omitempty"`
+
+	// ShedMaxRunning refuses new wakes with a 503 while this many VMs are
+	// running or waking, capping host load. Default: 0 (no limit).
+	ShedMaxRunning int `json:"shed_max_running,omitempty"`
+
+	// IdleConfirmations is how many consecutive idle watcher sweeps must
+	// find a VM idle before it is paused. Raising it guards against a single
+	// anomalous sweep (e.g. around a clock adjustment) pausing an active VM,
+	// at the cost of up to that many extra watch intervals. Default: 1.
+	IdleConfirmations int `json:"idle_confirmations,omitempty"`
+
+	// ReadyCheckPath enables a readiness probe: after a resume, the module
+	// polls GET http://<ip>:<ready_check_port><path> until it answers with a
+	// non-error status before proxying. Default: "" (no probe).
+	ReadyCheckPath string `json:"ready_check_path,omitempty"`
+
+	// ReadyCheckTCP enables a TCP readiness probe instead: after a resume,
+	// the module waits until <ip>:<ready_check_port> accepts connections.
+	// For apps without an HTTP health path. Mutually exclusive with
+	// ReadyCheckPath.
+	ReadyCheckTCP bool `json:"ready_check_tcp,omitempty"`
+
+	// ReadyCheckPort is the port the readiness probe connects to, for apps
+	// that serve health checks separately from traffic. Default: AppPort.
+	ReadyCheckPort int `json:"ready_check_port,omitempty"`
+
+	// ReadyCheckBeforeResume runs one readiness probe before resuming a VM
+	// believed paused and skips the resume if the app already answers,
+	// e.g. when a pause failed silently. Requires a readiness probe.
+	ReadyCheckBeforeResume bool `json:"ready_check_before_resume,omitempty"`
+
+	// ReadyCheckInterval is the delay between readiness probes.
+	// Default: 100ms.
+	ReadyCheckInterval caddy.Duration `json:"ready_check_interval,omitempty"`
+
+	// ReadyCheckHeader, if set, must be present on the probe response for
+	// the VM to count as ready, e.g. "X-App-Ready".
+	ReadyCheckHeader string `json:"ready_check_header,omitempty"`
+
+	// ReadyCheckHeaderValue, if set, is the value ReadyCheckHeader must have.
+	ReadyCheckHeaderValue string `json:"ready_check_header_value,omitempty"`
+
+	// TargetRunning keeps this many VMs running in each host group in
+	// steady state: an idle VM is only paused while more than this many are
+	// running in its group, least recently used app first, counting every
+	// replica. Unlike shed_max_running it is not a ceiling; active VMs are
+	// never paused for it. Default: 0 (pause every idle VM).
+	TargetRunning int `json:"target_running,omitempty"`
+
+	// PauseCoalesceWindow holds idle pauses for this long after a sweep
+	// first finds an app idle, so apps going idle over the next few watch
+	// intervals are paused together in one sweep rather than tick by tick.
+	// Default: 0 (pause on the sweep that finds them idle).
+	PauseCoalesceWindow caddy.Duration `json:"pause_coalesce_window,omitempty"`
+
+	// MaxRunningLifetime pauses a VM that has been running continuously for
+	// longer than this, regardless of activity, once its in-flight requests
+	// have drained. The next request resumes it afresh, which contains slow
+	// memory leaks in long-running guest apps. Default: 0 (disabled).
+	MaxRunningLifetime caddy.Duration `json:"max_running_lifetime,omitempty"`
+
+	// MinRunningTime is the minimum time a VM stays running after it
+	// resumes (or is first seen running) before the idle watcher may pause
+	// it, so a wake isn't undone by an idle sweep moments later. It only
+	// matters when it exceeds IdleTimeout, which already counts from the
+	// request that triggered the wake. Default: 0 (IdleTimeout alone).
+	MinRunningTime caddy.Duration `json:"min_running_time,omitempty"`
+
+	// PauseTimeout bounds each PauseVM call made by the idle watcher, so a
+	// hung pause cannot stall the sweep. Default: 15s.
+	PauseTimeout caddy.Duration `json:"pause_timeout,omitempty"`
+
+	// PauseConcurrency caps how many PauseVM calls one idle sweep runs at
+	// once. Slicer has no batch pause, so a sweep that finds many idle VMs
+	// pauses them through this many workers. Default: 4.
+	PauseConcurrency int `json:"pause_concurrency,omitempty"`
+
+	// PauseMode selects how idle VMs are put to sleep. "pause" (default)
+	// pauses them in memory for the fastest resume. "suspend" snapshots
+	// them to disk, freeing their memory at the cost of a slower restore.
+	PauseMode string `json:"pause_mode,omitempty"`
+
+	// DeepIdleTimeout, with pause_mode pause, suspends VMs to disk once
+	// they have been paused for this long, so short idle periods get the
+	// fast in-memory pause and long ones free the host's memory.
+	// Default: 0 (VMs stay paused).
+	DeepIdleTimeout caddy.Duration `json:"deep_idle_timeout,omitempty"`
+
+	// StateTTL is how long a cached VM lookup is trusted before the next
+	// request for the app fetches it from Slicer again, so deleted,
+	// re-tagged and newly created VMs are picked up without a restart.
+	// Entries for unknown apps expire too. Default: 60s; -1 ("off" in the
+	// Caddyfile) caches until a Slicer call fails.
+	StateTTL caddy.Duration `json:"state_ttl,omitempty"`
+
+	// StateHistorySize is how many recent state transitions are kept per
+	// app for the admin API history endpoint. Default: 20. Set to -1 to
+	// disable.
+	StateHistorySize int `json:"state_history_size,omitempty"`
+
+	// PersistState is a key in Caddy's storage where the state cache is
+	// saved after every idle sweep and on cleanup, and restored from on
+	// provisioning, so reloads and restarts keep each app's activity and
+	// idle-pause it on schedule. Handlers must use distinct keys. Default:
+	// "" (not persisted).
+	PersistState string `json:"persist_state,omitempty"`
+
+	// PersistStateMaxAge skips persisted apps last fetched from Slicer
+	// longer ago than this. Default: 1h.
+	PersistStateMaxAge caddy.Duration `json:"persist_state_max_age,omitempty"`
+
 	// AskListenAddr is the address for the on-demand TLS validation server.
 	// When set, an internal HTTP server starts that Caddy's on_demand_tls can
-	// query to check if a custom domain has a matching VM.
+	// query to check if a custom domain has a matching VM. Handlers with the
+	// same address share one server, which survives config reloads.
 	// Example: "127.0.0.1:5555"
 	AskListenAddr string `json:"ask_listen,omitempty"`
 
-	logger   *zap.Logger
-	client   *sdk.SlicerClient
-	stateMgr *vmStateManager
-	askSrv   *askServer
+	// AskTLS serves the ask endpoint over HTTPS only, using AskTLSCert and
+	// AskTLSKey if given or a self-signed certificate generated at startup.
+	AskTLS bool `json:"ask_tls,omitempty"`
+
+	// AskTLSCert and AskTLSKey are PEM files for the ask server
+	// certificate and its private key.
+	AskTLSCert string `json:"ask_tls_cert,omitempty"`
+	AskTLSKey  string `json:"ask_tls_key,omitempty"`
+
+	// AskReadTimeout bounds reading an ask request, including headers.
+	// Default: 5s.
+	AskReadTimeout caddy.Duration `json:"ask_read_timeout,omitempty"`
+
+	// AskWriteTimeout bounds handling and writing an ask response.
+	// Default: 15s.
+	AskWriteTimeout caddy.Duration `json:"ask_write_timeout,omitempty"`
+
+	// AskIdleTimeout is how long idle keep-alive connections to the ask
+	// server are kept open. Default: 60s.
+	AskIdleTimeout caddy.Duration `json:"ask_idle_timeout,omitempty"`
+
+	// AskNegativeCacheSize bounds the LRU of recently rejected ask domains.
+	// Default: 10000. Set to -1 to disable the cache.
+	AskNegativeCacheSize int `json:"ask_negative_cache_size,omitempty"`
+
+	// AskNegativeCacheTTL is how long a rejected ask domain is remembered.
+	// Default: 30s.
+	AskNegativeCacheTTL caddy.Duration `json:"ask_negative_cache_ttl,omitempty"`
+
+	// AskPositiveCacheSize bounds the LRU of recently approved ask
+	// domains, which are approved again without a lookup while cached.
+	// Default: 10000. Set to -1 to disable the cache.
+	AskPositiveCacheSize int `json:"ask_positive_cache_size,omitempty"`
+
+	// AskPositiveCacheTTL is how long an approved ask domain is
+	// remembered. Default: 60s.
+	AskPositiveCacheTTL caddy.Duration `json:"ask_positive_cache_ttl,omitempty"`
+
+	// AskMaxConcurrent caps concurrent ask lookups; excess requests get a
+	// 503. Default: 0 (unlimited).
+	AskMaxConcurrent int `json:"ask_max_concurrent,omitempty"`
+
+	// AskPrewake starts waking an approved domain's VM in the background,
+	// so it is resuming while the certificate is issued and the first
+	// request arrives. The ask response does not wait for it.
+	AskPrewake bool `json:"ask_prewake,omitempty"`
+
+	// WakeBypassRaw is a list of matcher sets identifying traffic that must
+	// never wake a VM or count as activity, such as internal admin tooling
+	// scraping metrics. Matching requests to a running VM are proxied as
+	// usual; matching requests to a paused VM get a 503 without a resume.
+	WakeBypassRaw caddyhttp.RawMatcherSets `json:"wake_bypass,omitempty" caddy:"namespace=http.matchers"`
+
+	// AppClaim routes by identity instead of hostname: the app name is read
+	// from this claim of the JWT the request carries. The token is decoded
+	// but not verified; put an authentication handler in front of this one.
+	// Requests without a token get a 401, malformed tokens a 400.
+	AppClaim string `json:"app_claim,omitempty"`
+
+	// AppClaimHeader is the header holding the token for AppClaim, with or
+	// without a "Bearer " prefix. Default: Authorization.
+	AppClaimHeader string `json:"app_claim_header,omitempty"`
+
+	// Maintenance starts the handler in maintenance mode: no VM is woken
+	// or paused and every request gets a 503 with MaintenanceMessage. It
+	// can be toggled at runtime through the admin API.
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// MaintenanceMessage is the response body served in maintenance mode.
+	// Default: "service is under maintenance, please retry later".
+	MaintenanceMessage string `json:"maintenance_message,omitempty"`
+
+	// ColdStartHeaders adds X-Slicer-App, X-Slicer-State (waking, failed,
+	// cooldown or shed) and X-Slicer-Poll-Ms headers to cold start 503s,
+	// so clients such as SPAs can render progress and poll efficiently.
+	// Default: false.
+	ColdStartHeaders bool `json:"cold_start_headers,omitempty"`
+
+	// DebugHeaders marks responses that had to wake their VM first with
+	// X-Slicer-Cold-Start, X-Slicer-Wake-Duration and a Server-Timing
+	// entry, so clients and monitoring can see what a cold start cost.
+	// Default: false.
+	DebugHeaders bool `json:"debug_headers,omitempty"`
+
+	// WaitingPage is an HTML template file served instead of the plain-text
+	// 503 while an app is starting up or failed to start. It is rendered
+	// with .App, .RetryAfter (seconds), .State and .Message. Default: ""
+	// (plain text).
+	WaitingPage string `json:"waiting_page,omitempty"`
+
+	// WaitingPageTemplate is an inline alternative to WaitingPage.
+	WaitingPageTemplate string `json:"waiting_page_template,omitempty"`
+
+	// ColdStartPollInterval is the X-Slicer-Poll-Ms suggestion sent with
+	// ColdStartHeaders. Default: 500ms.
+	ColdStartPollInterval caddy.Duration `json:"cold_start_poll_interval,omitempty"`
+
+	// ColdStartRedirect, if set, answers GET and HEAD requests for an app
+	// that is not running with a 302 to this URL instead of blocking, with
+	// the app name and original URL added as the "app" and "url" query
+	// parameters. The wake continues in the background, so the app is
+	// ready by the time the status page sends the client back.
+	ColdStartRedirect string `json:"cold_start_redirect,omitempty"`
+
+	// ColdStartBufferLimit, in bytes, reads the body of a request to an app
+	// that is not running into memory while it wakes, so a slow wake does
+	// not leave the client's upload stalled; the buffered body is proxied
+	// once the app is ready. Requests with larger bodies get a 503.
+	// Default: 0 (bodies stream through after the wake).
+	ColdStartBufferLimit int64 `json:"cold_start_buffer_limit,omitempty"`
+
+	// MaxBufferedBody, in bytes, buffers cold request bodies like
+	// ColdStartBufferLimit, but bodies larger than it are not rejected:
+	// they stream through after the wake, as without buffering. Mutually
+	// exclusive with ColdStartBufferLimit. Default: 0 (disabled).
+	MaxBufferedBody int64 `json:"max_buffered_body,omitempty"`
+
+	// ExpectContinue controls "Expect: 100-continue" requests that arrive
+	// while the VM is paused. "early" (default) sends the interim 100 before
+	// waking, so the client starts uploading while the VM resumes. "defer"
+	// withholds it until the request is proxied, after the wake.
+	ExpectContinue string `json:"expect_continue,omitempty"`
+
+	// NotFoundRules customise the response for app names with no matching
+	// VM, e.g. 410 for decommissioned apps or a redirect for a catch-all.
+	// Rules are tried in order against the full hostname and its first
+	// label; unmatched names get a plain 404.
+	NotFoundRules []*NotFoundRule `json:"not_found_rules,omitempty"`
+
+	// WakeErrors customise the response for requests whose app could not
+	// be made ready, keyed by the X-Slicer-State of the failure: "waking"
+	// (the wake timed out or is still running), "failed", "cooldown" or
+	// "shed". States without an entry get a 503 with a built-in message.
+	WakeErrors map[string]*WakeErrorResponse `json:"wake_errors,omitempty"`
+
+	// NotFoundAction is what happens to requests for unknown app names
+	// that no NotFoundRule matches: "error" (default) responds 404,
+	// "passthrough" hands them to the next handler without setting the
+	// upstream vars, so another route can serve them.
+	NotFoundAction string `json:"not_found_action,omitempty"`
+
+	// Aliases maps alternative app names (hostnames or first labels) to a
+	// canonical app name. Requests to any alias are looked up, woken and
+	// idle-tracked as the canonical app, so aliases never pause
+	// independently of each other.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// ReservedNames maps subdomains that must not be treated as app names
+	// (e.g. "www", "api") to how they are handled instead. Keys are matched
+	// against the full hostname first, then its first label.
+	ReservedNames map[string]*ReservedName `json:"reserved_names,omitempty"`
+
+	// PauseAfterRequest lists apps that are paused as soon as their last
+	// in-flight request completes, instead of waiting for IdleTimeout.
+	// Useful for one-shot workloads such as webhook receivers.
+	PauseAfterRequest []string `json:"pause_after_request,omitempty"`
+
+	// WarmupRequests maps app names (hostnames or first labels) to paths
+	// that are fetched with GET, in order, after the app wakes and before
+	// the waiting requests are proxied, to prime caches and JITs. Failures
+	// are logged and ignored; the warmup is bounded by WakeTimeout.
+	WarmupRequests map[string][]string `json:"warmup_requests,omitempty"`
+
+	// MetricsPerApp adds the app name as a label to the wake metrics. Off by
+	// default because every app becomes its own series.
+	MetricsPerApp bool `json:"metrics_per_app,omitempty"`
+
+	// Prewarm lists apps resumed in the background right after the handler
+	// is provisioned, so the busiest apps are running before the first
+	// request after a deploy. They then idle out normally.
+	Prewarm []string `json:"prewarm,omitempty"`
+
+	// ScheduledWakes proactively resumes apps at fixed times, e.g. warming
+	// a reporting app before a daily job runs.
+	ScheduledWakes []*ScheduledWake `json:"scheduled_wakes,omitempty"`
+
+	// WarmWindows keep apps running during recurring time windows, such as
+	// business hours, resuming them if needed; outside the windows they
+	// idle normally.
+	WarmWindows []*WarmWindow `json:"warm_windows,omitempty"`
+
+	logger     *zap.Logger
+	client     *sdk.SlicerClient
+	stateMgr   *vmStateManager
+	askSrv     *askServer
+	resolver   *upstreamResolver
+	wakeBypass caddyhttp.MatcherSets
+
+	// waitingPage is the parsed WaitingPage or WaitingPageTemplate.
+	waitingPage *template.Template
+
+	// maintenance is the runtime maintenance flag, seeded from Maintenance.
+	maintenance *atomic.Bool
+
+	// scopedMaintenance holds the apps and host groups put into
+	// maintenance through the admin API.
+	scopedMaintenance *scopedMaintenance
+}
+
+// WakeErrorResponse is the response for one kind of wake failure.
+type WakeErrorResponse struct {
+	// StatusCode is the response status. Default: 503.
+	StatusCode int `json:"status_code,omitempty"`
+
+	// Body replaces the built-in message, in plain text and as the
+	// waiting page's {{.Message}}. Placeholders are expanded, e.g.
+	// {http.request.uuid} to give users an ID to quote to support.
+	Body string `json:"body,omitempty"`
+}
+
+// NotFoundRule is the response for unknown app names matching Pattern.
+type NotFoundRule struct {
+	// Pattern is a shell-style glob such as "old-*" or "*".
+	Pattern string `json:"pattern"`
+
+	// StatusCode is the response status, e.g. 404, 410 or 302.
+	StatusCode int `json:"status_code"`
+
+	// Location, if set, redirects the client there with StatusCode,
+	// which must be a 3xx code.
+	Location string `json:"location,omitempty"`
+
+	// Body is the response body for non-redirect responses.
+	Body string `json:"body,omitempty"`
+}
+
+// Values for ExpectContinue.
+const (
+	expectContinueEarly = "early"
+	expectContinueDefer = "defer"
+)
+
+// Values for RouteMode.
+const (
+	routeModeHost          = "host"
+	routeModePath          = "path"
+	routeModeSubdomainPath = "subdomain_path"
+)
+
+// Values for NotFoundAction.
+const (
+	notFoundActionError       = "error"
+	notFoundActionPassthrough = "passthrough"
+)
+
+// Values for UpstreamProto.
+const (
+	upstreamProtoHTTP1 = "http1"
+	upstreamProtoH2C   = "h2c"
+	upstreamProtoH2    = "h2"
+)
+
+// Values for PauseMode.
+const (
+	pauseModePause   = "pause"
+	pauseModeSuspend = "suspend"
+)
+
+// Values for TagMatch.
+const (
+	tagMatchAuto     = "auto"
+	tagMatchHostname = "hostname"
+)
+
+// Values for LoadBalancing.
+const (
+	loadBalancingSticky     = "sticky"
+	loadBalancingRoundRobin = "round_robin"
+)
+
+// Values for UpstreamScheme.
+const (
+	upstreamSchemeHTTP  = "http"
+	upstreamSchemeHTTPS = "https"
+)
+
+// Values for UpstreamTarget.
+const (
+	upstreamTargetIP       = "ip"
+	upstreamTargetHostname = "hostname"
+)
+
+// Actions for a reserved name.
+const (
+	reservedNotFound = "not_found"
+	reservedUpstream = "upstream"
+	reservedApp      = "app"
+)
+
+// ReservedName describes how requests for a reserved name are handled.
+type ReservedName struct {
+	// Action is one of "not_found", "upstream" or "app".
+	Action string `json:"action"`
+
+	// Upstream is the fixed host:port to proxy to for the "upstream" action.
+	Upstream string `json:"upstream,omitempty"`
+
+	// App is the app name to route to instead for the "app" action.
+	App string `json:"app,omitempty"`
+}
+
+// ScheduledWake resumes an app whenever its cron schedule fires.
+type ScheduledWake struct {
+	// App is the app name (tag or hostname) to wake.
+	App string `json:"app"`
+
+	// Cron is a standard five-field cron expression evaluated in the
+	// server's local time zone, e.g. "0 6 * * 1-5".
+	Cron string `json:"cron"`
+
+	// KeepWarm holds the app running for at least this long after a
+	// scheduled wake, even without traffic. Default: 0 (normal idling).
+	KeepWarm caddy.Duration `json:"keep_warm,omitempty"`
+
+	schedule *cronSchedule
 }
 
 func (s *SlicerVM) Provision(ctx caddy.Context) error {
@@ -66,27 +702,272 @@ func (s *SlicerVM) Provision(ctx caddy.Context) error {
 	if s.WakeTimeout == 0 {
 		s.WakeTimeout = caddy.Duration(30 * time.Second)
 	}
+	if s.ResumeTimeout == 0 {
+		s.ResumeTimeout = s.WakeTimeout
+	}
 	if s.AppPort == 0 {
 		s.AppPort = 8080
 	}
+	if s.ReadyCheckPort == 0 {
+		s.ReadyCheckPort = s.AppPort
+	}
 	if s.WatchInterval == 0 {
 		s.WatchInterval = caddy.Duration(30 * time.Second)
 	}
+	if s.WatchJitter == 0 {
+		s.WatchJitter = 0.1
+	}
+	if s.ColdStartPollInterval == 0 {
+		s.ColdStartPollInterval = caddy.Duration(500 * time.Millisecond)
+	}
+	if s.ExpectContinue == "" {
+		s.ExpectContinue = expectContinueEarly
+	}
+	if s.AskNegativeCacheSize == 0 {
+		s.AskNegativeCacheSize = 10000
+	}
+	if s.AskNegativeCacheTTL == 0 {
+		s.AskNegativeCacheTTL = caddy.Duration(30 * time.Second)
+	}
+	if s.AskPositiveCacheSize == 0 {
+		s.AskPositiveCacheSize = 10000
+	}
+	if s.AskPositiveCacheTTL == 0 {
+		s.AskPositiveCacheTTL = caddy.Duration(60 * time.Second)
+	}
+	if s.MaintenanceMessage == "" {
+		s.MaintenanceMessage = "service is under maintenance, please retry later"
+	}
+	s.maintenance = new(atomic.Bool)
+	s.maintenance.Store(s.Maintenance)
+	s.scopedMaintenance = newScopedMaintenance()
+	if s.AskReadTimeout == 0 {
+		s.AskReadTimeout = caddy.Duration(5 * time.Second)
+	}
+	if s.AskWriteTimeout == 0 {
+		s.AskWriteTimeout = caddy.Duration(15 * time.Second)
+	}
+	if s.AskIdleTimeout == 0 {
+		s.AskIdleTimeout = caddy.Duration(60 * time.Second)
+	}
+	if s.WakeRetries == 0 {
+		s.WakeRetries = 2
+	}
+	if s.WakeRetryBackoff == 0 {
+		s.WakeRetryBackoff = caddy.Duration(200 * time.Millisecond)
+	}
+	if s.WakeCooldownMax == 0 {
+		s.WakeCooldownMax = caddy.Duration(5 * time.Minute)
+	}
+	if s.WakeFailureThreshold == 0 {
+		s.WakeFailureThreshold = 1
+	}
+	if s.IdleConfirmations == 0 {
+		s.IdleConfirmations = 1
+	}
+	if s.ReadyCheckInterval == 0 {
+		s.ReadyCheckInterval = caddy.Duration(100 * time.Millisecond)
+	}
+	if s.PauseTimeout == 0 {
+		s.PauseTimeout = caddy.Duration(15 * time.Second)
+	}
+	if s.WakeNodeConcurrency == 0 {
+		s.WakeNodeConcurrency = 4
+	}
+	if s.PauseConcurrency == 0 {
+		s.PauseConcurrency = 4
+	}
+	if s.StateTTL == 0 {
+		s.StateTTL = caddy.Duration(60 * time.Second)
+	}
+	if s.StateHistorySize == 0 {
+		s.StateHistorySize = 20
+	}
+	if s.PersistStateMaxAge == 0 {
+		s.PersistStateMaxAge = caddy.Duration(time.Hour)
+	}
+	if s.UpstreamTarget == "" {
+		s.UpstreamTarget = upstreamTargetIP
+	}
+	if s.RetryAfter == 0 {
+		s.RetryAfter = caddy.Duration(5 * time.Second)
+	}
+	if s.UpstreamVar == "" {
+		s.UpstreamVar = "relight_slicervm_upstream"
+	}
+	if s.UpstreamScheme == "" {
+		s.UpstreamScheme = upstreamSchemeHTTP
+	}
+	if s.UpstreamProto == "" {
+		s.UpstreamProto = upstreamProtoHTTP1
+	}
+	if s.LoadBalancing == "" {
+		s.LoadBalancing = loadBalancingSticky
+	}
+	if s.TagMatch == "" {
+		s.TagMatch = tagMatchAuto
+	}
+	if s.PauseMode == "" {
+		s.PauseMode = pauseModePause
+	}
+	if s.NotFoundAction == "" {
+		s.NotFoundAction = notFoundActionError
+	}
+	if s.RouteMode == "" {
+		s.RouteMode = routeModeHost
+	}
+	for i, suffix := range s.DomainSuffixes {
+		s.DomainSuffixes[i] = strings.ToLower(strings.Trim(suffix, "."))
+	}
+	needResolver := s.UpstreamTarget == upstreamTargetHostname
+	for _, target := range s.AppUpstreamTargets {
+		needResolver = needResolver || target == upstreamTargetHostname
+	}
+	if needResolver {
+		s.resolver = newUpstreamResolver(time.Duration(s.UpstreamStaleMax))
+	}
+
+	if s.WakeBypassRaw != nil {
+		matchers, err := ctx.LoadModule(s, "WakeBypassRaw")
+		if err != nil {
+			return fmt.Errorf("loading wake_bypass matchers: %w", err)
+		}
+		if err := s.wakeBypass.FromInterface(matchers); err != nil {
+			return fmt.Errorf("loading wake_bypass matchers: %w", err)
+		}
+	}
+
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+
+	for _, w := range s.WarmWindows {
+		if err := w.parse(); err != nil {
+			return fmt.Errorf("warm_window %q: %w", w.App, err)
+		}
+	}
+	for _, sw := range s.ScheduledWakes {
+		schedule, err := parseCron(sw.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule_wake %q: %w", sw.App, err)
+		}
+		sw.schedule = schedule
+	}
 
-	httpClient, baseURL := buildHTTPClient(s.SlicerURL)
-	s.client = sdk.NewSlicerClient(baseURL, s.SlicerToken, "caddy-relight-slicervm", httpClient)
-	s.stateMgr = newVMStateManager(s.client, s.HostGroup, s.logger)
+	slicerURL, err := resolveStorageValue(ctx, "slicer_url", s.SlicerURL)
+	if err != nil {
+		return err
+	}
+	slicerToken, err := resolveStorageValue(ctx, "slicer_token", s.SlicerToken)
+	if err != nil {
+		return err
+	}
+
+	httpClient, baseURL, err := buildHTTPClient(slicerURL, time.Duration(s.SlicerTimeout))
+	if err != nil {
+		return err
+	}
+	s.client = sdk.NewSlicerClient(baseURL, slicerToken, "caddy-relight-slicervm", httpClient)
+	if s.StartupCheck {
+		checkCtx, cancel := context.WithTimeout(ctx, s.slicerCallTimeout(10*time.Second))
+		err := checkSlicerAccess(checkCtx, s.client, s.hostGroups(), s.StartupCheckSkipPermissions, s.suspends())
+		cancel()
+		if err != nil {
+			return fmt.Errorf("startup check: %w", err)
+		}
+	}
+
+	s.stateMgr = newVMStateManager(s.client, strings.Join(s.hostGroups(), ","), s.logger)
+	s.stateMgr.hostGroups = s.hostGroups()
+	s.stateMgr.healthTimeout = s.slicerCallTimeout(healthCheckTimeout)
+	s.stateMgr.groupSuffixes = s.HostGroupSuffixes
+	s.stateMgr.wakeCooldown = time.Duration(s.WakeCooldown)
+	s.stateMgr.wakeCooldownMax = time.Duration(s.WakeCooldownMax)
+	s.stateMgr.wakeFailureThreshold = s.WakeFailureThreshold
+	s.stateMgr.shedMaxWaking = s.ShedMaxWaking
+	s.stateMgr.shedMaxRunning = s.ShedMaxRunning
+	s.stateMgr.appPort = s.AppPort
+	s.stateMgr.appPorts = s.AppPorts
+	s.stateMgr.minRunningTime = time.Duration(s.MinRunningTime)
+	s.stateMgr.wakeConcurrency = s.WakeNodeConcurrency
+	if s.MaxConcurrentWakes > 0 {
+		s.stateMgr.wakeSlots = make(chan struct{}, s.MaxConcurrentWakes)
+	}
+	s.stateMgr.probeFirst = s.ReadyCheckBeforeResume
+	s.stateMgr.warmups = s.WarmupRequests
+	s.stateMgr.metricsPerApp = s.MetricsPerApp
+	s.stateMgr.caddyCtx = ctx
+	s.stateMgr.maintenance = s.maintenance
+	eventsApp, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	s.stateMgr.events = eventsApp.(*caddyevents.App)
+	s.stateMgr.roundRobin = s.LoadBalancing == loadBalancingRoundRobin
+	s.stateMgr.exactTags = s.TagMatch == tagMatchHostname
+	s.stateMgr.minReplicas = s.MinReplicas
+	s.stateMgr.upstreamScheme = s.UpstreamScheme
+	s.stateMgr.upstreamClient = newUpstreamClient(s.UpstreamTLSInsecure, s.UpstreamProto)
+	s.stateMgr.wakeTimeout = time.Duration(s.WakeTimeout)
+	s.stateMgr.resumeTimeout = time.Duration(s.ResumeTimeout)
+	s.stateMgr.wakeRetries = max(s.WakeRetries, 0)
+	s.stateMgr.wakeRetryBackoff = time.Duration(s.WakeRetryBackoff)
+	s.stateMgr.historySize = s.StateHistorySize
+	s.stateMgr.stateTTL = max(time.Duration(s.StateTTL), 0)
+	if s.PersistState != "" {
+		s.stateMgr.loadState(s.PersistState, time.Duration(s.PersistStateMaxAge))
+	}
+	if s.ReadyCheckPath != "" || s.ReadyCheckTCP {
+		s.stateMgr.probe = newReadinessProbe(s.ReadyCheckPath, s.ReadyCheckPort, time.Duration(s.ReadyCheckInterval),
+			s.ReadyCheckHeader, s.ReadyCheckHeaderValue)
+		s.stateMgr.probe.scheme = s.UpstreamScheme
+		s.stateMgr.probe.client.Transport = s.stateMgr.upstreamClient.Transport
+		if s.ReadyCheckPort != s.AppPort {
+			s.logger.Info("readiness probe uses a different port than app_port",
+				zap.Int("ready_check_port", s.ReadyCheckPort),
+				zap.Int("app_port", s.AppPort),
+			)
+		}
+	}
 
 	startIdleWatcher(s)
+	startWakeScheduler(s)
+	startWarmWindows(s)
+	prewarmApps(s)
 
 	if s.AskListenAddr != "" {
-		ask, err := newAskServer(s.AskListenAddr, s.stateMgr, s.logger)
+		opts := askServerOptions{
+			readTimeout:   time.Duration(s.AskReadTimeout),
+			writeTimeout:  time.Duration(s.AskWriteTimeout),
+			idleTimeout:   time.Duration(s.AskIdleTimeout),
+			maxConcurrent: s.AskMaxConcurrent,
+			lookupTimeout: s.slicerCallTimeout(10 * time.Second),
+			prewake:       s.AskPrewake,
+
+			negativeCacheSize: s.AskNegativeCacheSize,
+			negativeCacheTTL:  time.Duration(s.AskNegativeCacheTTL),
+			positiveCacheSize: s.AskPositiveCacheSize,
+			positiveCacheTTL:  time.Duration(s.AskPositiveCacheTTL),
+		}
+		if s.AskTLS {
+			opts.tlsCert, opts.tlsKey = s.AskTLSCert, s.AskTLSKey
+			if opts.tlsConfig, err = askTLSConfig(s.AskTLSCert, s.AskTLSKey, s.AskListenAddr); err != nil {
+				return err
+			}
+		}
+		ask, err := acquireAskServer(s.AskListenAddr, s.stateMgr, s.logger, opts)
 		if err != nil {
 			return fmt.Errorf("starting ask server: %w", err)
 		}
 		s.askSrv = ask
 	}
 
+	if s.waitingPage, err = loadWaitingPage(s.WaitingPage, s.WaitingPageTemplate); err != nil {
+		return err
+	}
+
+	registerInstance(s)
+
 	return nil
 }
 
@@ -97,46 +978,435 @@ func (s *SlicerVM) Validate() error {
 	if s.SlicerToken == "" {
 		return fmt.Errorf("slicer_token is required")
 	}
-	if s.HostGroup == "" {
+	groups := s.hostGroups()
+	if len(groups) == 0 {
 		return fmt.Errorf("host_group is required")
 	}
+	for _, group := range s.HostGroups {
+		if group == "" {
+			return fmt.Errorf("host_groups must not contain empty names")
+		}
+	}
+	for suffix, group := range s.HostGroupSuffixes {
+		if suffix == "" {
+			return fmt.Errorf("host_group domain suffix must not be empty")
+		}
+		if !slices.Contains(groups, group) {
+			return fmt.Errorf("host_group suffix %q: unknown host group %q", suffix, group)
+		}
+	}
 	if time.Duration(s.IdleTimeout) < 30*time.Second {
 		return fmt.Errorf("idle_timeout must be at least 30s")
 	}
+	if s.SlicerTimeout < 0 {
+		return fmt.Errorf("slicer_timeout must not be negative")
+	}
+	if s.WakeTimeout <= 0 || time.Duration(s.WakeTimeout) > 10*time.Minute {
+		return fmt.Errorf("wake_timeout must be between 0 and 10m, got %s", time.Duration(s.WakeTimeout))
+	}
+	if time.Duration(s.WatchInterval) < time.Second {
+		return fmt.Errorf("watch_interval must be at least 1s, got %s", time.Duration(s.WatchInterval))
+	}
+	if s.WakeRetries < -1 {
+		return fmt.Errorf("wake_retries must be -1 (disabled) or positive")
+	}
+	if s.WakeRetryBackoff < 0 {
+		return fmt.Errorf("wake_retry_backoff must not be negative")
+	}
+	if s.StateTTL < 0 && s.StateTTL != caddy.Duration(-1) {
+		return fmt.Errorf("state_ttl must be -1 (disabled) or positive")
+	}
+	if s.PersistStateMaxAge < 0 {
+		return fmt.Errorf("persist_state max age must not be negative")
+	}
+	if s.StateHistorySize < -1 {
+		return fmt.Errorf("state_history_size must be -1 (disabled) or positive")
+	}
+	if s.WakeNodeConcurrency < 1 {
+		return fmt.Errorf("wake_node_concurrency must be at least 1")
+	}
+	if s.PauseConcurrency < 1 {
+		return fmt.Errorf("pause_concurrency must be at least 1")
+	}
+	if s.MaxConcurrentWakes < 0 {
+		return fmt.Errorf("max_concurrent_wakes must not be negative")
+	}
+	if s.MinReplicas < 0 {
+		return fmt.Errorf("min_replicas must not be negative")
+	}
+	if s.NotFoundAction != notFoundActionError && s.NotFoundAction != notFoundActionPassthrough {
+		return fmt.Errorf("not_found_action must be %q or %q", notFoundActionError, notFoundActionPassthrough)
+	}
+	if s.TagMatch != tagMatchAuto && s.TagMatch != tagMatchHostname {
+		return fmt.Errorf("tag_match must be %q or %q", tagMatchAuto, tagMatchHostname)
+	}
+	if s.PauseMode != pauseModePause && s.PauseMode != pauseModeSuspend {
+		return fmt.Errorf("pause_mode must be %q or %q", pauseModePause, pauseModeSuspend)
+	}
+	if s.DeepIdleTimeout < 0 {
+		return fmt.Errorf("deep_idle_timeout must not be negative")
+	}
+	if s.DeepIdleTimeout > 0 && s.PauseMode != pauseModePause {
+		return fmt.Errorf("deep_idle_timeout requires pause_mode %q", pauseModePause)
+	}
+	if s.LoadBalancing != loadBalancingSticky && s.LoadBalancing != loadBalancingRoundRobin {
+		return fmt.Errorf("load_balancing must be %q or %q", loadBalancingSticky, loadBalancingRoundRobin)
+	}
+	if s.WakeCooldown < 0 || s.WakeCooldownMax < s.WakeCooldown {
+		return fmt.Errorf("wake_cooldown must be between 0 and wake_cooldown_max")
+	}
+	if s.WakeFailureThreshold < 1 {
+		return fmt.Errorf("wake_failure_threshold must be at least 1")
+	}
+	if s.ColdStartRedirect != "" {
+		if u, err := url.Parse(s.ColdStartRedirect); err != nil || !u.IsAbs() {
+			return fmt.Errorf("cold_start_redirect must be an absolute URL")
+		}
+	}
+	if s.ResumeTimeout < 0 || s.ResumeTimeout > s.WakeTimeout {
+		return fmt.Errorf("resume_timeout must be positive and no longer than wake_timeout")
+	}
+	if s.RetryAfter < caddy.Duration(time.Second) {
+		return fmt.Errorf("retry_after must be at least 1s")
+	}
+	if s.FastFailAfter < 0 || (s.FastFailAfter > 0 && s.FastFailAfter >= s.WakeTimeout) {
+		return fmt.Errorf("fast_fail_after must be shorter than wake_timeout")
+	}
+	if s.ColdStartBufferLimit < 0 || s.MaxBufferedBody < 0 {
+		return fmt.Errorf("cold_start_buffer_limit and max_buffered_body must not be negative")
+	}
+	if s.ColdStartBufferLimit > 0 && s.MaxBufferedBody > 0 {
+		return fmt.Errorf("cold_start_buffer_limit and max_buffered_body are mutually exclusive")
+	}
+	if s.TargetRunning < 0 {
+		return fmt.Errorf("target_running must not be negative")
+	}
+	if s.PauseCoalesceWindow < 0 {
+		return fmt.Errorf("pause_coalesce_window must not be negative")
+	}
+	if s.MinRunningTime < 0 {
+		return fmt.Errorf("min_running_time must not be negative")
+	}
+	if s.WatchJitter != -1 && (s.WatchJitter < 0 || s.WatchJitter >= 1) {
+		return fmt.Errorf("watch_jitter must be -1 (off) or a fraction from 0 to below 1")
+	}
+	if s.MaxRunningLifetime != 0 && time.Duration(s.MaxRunningLifetime) < time.Duration(s.WatchInterval) {
+		return fmt.Errorf("max_running_lifetime must be at least watch_interval")
+	}
+	switch s.RouteMode {
+	case routeModeHost, routeModePath, routeModeSubdomainPath:
+	default:
+		return fmt.Errorf("route_mode must be %q, %q or %q", routeModeHost, routeModePath, routeModeSubdomainPath)
+	}
+	if s.AppLabelIndex < 0 {
+		return fmt.Errorf("app_label_index must not be negative")
+	}
+	if s.AppLabelIndex > 0 && s.RouteMode != routeModeHost {
+		return fmt.Errorf("app_label_index requires route_mode %q", routeModeHost)
+	}
+	if len(s.DomainSuffixes) > 0 && (s.RouteMode != routeModeHost || s.AppLabelIndex > 0) {
+		return fmt.Errorf("domain_suffix requires route_mode %q and no app_label_index", routeModeHost)
+	}
+	if slices.Contains(s.DomainSuffixes, "") {
+		return fmt.Errorf("domain_suffix must not be empty")
+	}
+	if s.TrustForwardedFor && !s.ForwardClientIP {
+		return fmt.Errorf("trust_forwarded_for requires forward_client_ip")
+	}
+	if !validVarName(s.UpstreamVar) {
+		return fmt.Errorf("upstream_var %q must contain only letters, digits and underscores", s.UpstreamVar)
+	}
+	if s.UpstreamScheme != upstreamSchemeHTTP && s.UpstreamScheme != upstreamSchemeHTTPS {
+		return fmt.Errorf("upstream_scheme must be %q or %q", upstreamSchemeHTTP, upstreamSchemeHTTPS)
+	}
+	if s.UpstreamTLSInsecure && s.UpstreamScheme != upstreamSchemeHTTPS {
+		return fmt.Errorf("upstream_tls_insecure requires upstream_scheme %q", upstreamSchemeHTTPS)
+	}
+	switch s.UpstreamProto {
+	case upstreamProtoHTTP1:
+	case upstreamProtoH2C:
+		if s.UpstreamScheme != upstreamSchemeHTTP {
+			return fmt.Errorf("upstream_proto %q requires upstream_scheme %q", upstreamProtoH2C, upstreamSchemeHTTP)
+		}
+	case upstreamProtoH2:
+		if s.UpstreamScheme != upstreamSchemeHTTPS {
+			return fmt.Errorf("upstream_proto %q requires upstream_scheme %q", upstreamProtoH2, upstreamSchemeHTTPS)
+		}
+	default:
+		return fmt.Errorf("upstream_proto must be %q, %q or %q", upstreamProtoHTTP1, upstreamProtoH2C, upstreamProtoH2)
+	}
+	switch s.UpstreamTarget {
+	case upstreamTargetIP, upstreamTargetHostname:
+	default:
+		return fmt.Errorf("upstream_target must be %q or %q", upstreamTargetIP, upstreamTargetHostname)
+	}
+	for app, target := range s.AppUpstreamTargets {
+		if target != upstreamTargetIP && target != upstreamTargetHostname {
+			return fmt.Errorf("upstream_target for %q must be %q or %q", app, upstreamTargetIP, upstreamTargetHostname)
+		}
+	}
+	if s.UpstreamStaleMax < 0 {
+		return fmt.Errorf("upstream_stale_max must not be negative")
+	}
+	if s.ShedMaxWaking < 0 || s.ShedMaxRunning < 0 {
+		return fmt.Errorf("shed_max_waking and shed_max_running must not be negative")
+	}
+	if s.ReadyCheckPath != "" && !strings.HasPrefix(s.ReadyCheckPath, "/") {
+		return fmt.Errorf("ready_check_path must start with /")
+	}
+	if s.ReadyCheckTCP && s.ReadyCheckPath != "" {
+		return fmt.Errorf("ready_check_tcp and ready_check_path are mutually exclusive")
+	}
+	if s.ReadyCheckHeader != "" && s.ReadyCheckPath == "" {
+		return fmt.Errorf("ready_check_header requires ready_check_path")
+	}
+	if s.ReadyCheckPort < 1 || s.ReadyCheckPort > 65535 {
+		return fmt.Errorf("ready_check_port must be between 1 and 65535")
+	}
+	if s.ReadyCheckPort != s.AppPort && s.ReadyCheckPath == "" && !s.ReadyCheckTCP {
+		return fmt.Errorf("ready_check_port requires ready_check_path or ready_check_tcp")
+	}
+	if s.ReadyCheckBeforeResume && s.ReadyCheckPath == "" && !s.ReadyCheckTCP {
+		return fmt.Errorf("ready_check_before_resume requires ready_check_path or ready_check_tcp")
+	}
+	if s.ReadyCheckInterval < 0 {
+		return fmt.Errorf("ready_check_interval must not be negative")
+	}
+	if s.IdleConfirmations < 1 {
+		return fmt.Errorf("idle_confirmations must be at least 1")
+	}
 	if s.AppPort < 1 || s.AppPort > 65535 {
 		return fmt.Errorf("app_port must be between 1 and 65535")
 	}
+	for app, port := range s.AppPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("app_port_override %q: port must be between 1 and 65535", app)
+		}
+	}
+	if s.ExpectContinue != expectContinueEarly && s.ExpectContinue != expectContinueDefer {
+		return fmt.Errorf("expect_continue must be %q or %q", expectContinueEarly, expectContinueDefer)
+	}
+	if (s.AskTLSCert == "") != (s.AskTLSKey == "") {
+		return fmt.Errorf("ask_tls needs both a certificate and a key file")
+	}
+	if s.WaitingPage != "" && s.WaitingPageTemplate != "" {
+		return fmt.Errorf("waiting_page accepts a file or an inline template, not both")
+	}
+	if s.AskTLSCert != "" && !s.AskTLS {
+		return fmt.Errorf("ask_tls_cert requires ask_tls")
+	}
+	if s.AskTLS && s.AskListenAddr == "" {
+		return fmt.Errorf("ask_tls requires ask_listen")
+	}
+	if s.AskNegativeCacheSize < -1 || s.AskNegativeCacheTTL < 0 {
+		return fmt.Errorf("ask_negative_cache size must be positive or -1, and ttl must not be negative")
+	}
+	if s.AskPositiveCacheSize < -1 || s.AskPositiveCacheTTL < 0 {
+		return fmt.Errorf("ask_positive_cache size must be positive or -1, and ttl must not be negative")
+	}
+	if s.AskMaxConcurrent < 0 {
+		return fmt.Errorf("ask_max_concurrent must not be negative")
+	}
+	for _, sw := range s.ScheduledWakes {
+		if sw.App == "" {
+			return fmt.Errorf("schedule_wake: app is required")
+		}
+		if sw.KeepWarm < 0 {
+			return fmt.Errorf("schedule_wake %q: keep_warm must not be negative", sw.App)
+		}
+	}
+	for _, w := range s.WarmWindows {
+		if w.App == "" {
+			return fmt.Errorf("warm_window: app is required")
+		}
+	}
+	for app, paths := range s.WarmupRequests {
+		for _, path := range paths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("warmup_requests %q: path %q must start with /", app, path)
+			}
+		}
+	}
+	for alias, canonical := range s.Aliases {
+		if canonical == "" {
+			return fmt.Errorf("alias %q: canonical app is required", alias)
+		}
+		if _, chained := s.Aliases[canonical]; chained {
+			return fmt.Errorf("alias %q: canonical app %q is itself an alias", alias, canonical)
+		}
+	}
+	for _, rule := range s.NotFoundRules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("not_found %q: invalid pattern: %v", rule.Pattern, err)
+		}
+		if rule.StatusCode < 300 || rule.StatusCode > 599 {
+			return fmt.Errorf("not_found %q: status must be between 300 and 599", rule.Pattern)
+		}
+		if isRedirect := rule.StatusCode < 400; isRedirect != (rule.Location != "") {
+			return fmt.Errorf("not_found %q: a location must be given with, and only with, a 3xx status", rule.Pattern)
+		}
+	}
+	for state, resp := range s.WakeErrors {
+		switch state {
+		case stateWaking, stateFailed, stateCooldown, stateShed:
+		default:
+			return fmt.Errorf("wake_error: unknown state %q", state)
+		}
+		if resp.StatusCode != 0 && (resp.StatusCode < 400 || resp.StatusCode > 599) {
+			return fmt.Errorf("wake_error %s: status must be 4xx or 5xx", state)
+		}
+	}
+	for name, rn := range s.ReservedNames {
+		switch rn.Action {
+		case reservedNotFound:
+		case reservedUpstream:
+			if rn.Upstream == "" {
+				return fmt.Errorf("reserved name %q: upstream is required", name)
+			}
+		case reservedApp:
+			if rn.App == "" {
+				return fmt.Errorf("reserved name %q: app is required", name)
+			}
+		default:
+			return fmt.Errorf("reserved name %q: unknown action %q", name, rn.Action)
+		}
+	}
 	return nil
 }
 
 func (s *SlicerVM) Cleanup() error {
+	unregisterInstance(s)
 	stopIdleWatcher(s)
+	stopWakeScheduler(s)
+	stopWarmWindows(s)
 	if s.askSrv != nil {
-		s.askSrv.close()
+		releaseAskServer(s.AskListenAddr, s.stateMgr)
+	}
+	if s.stateMgr != nil {
+		s.stateMgr.drain(cleanupDrainTimeout)
+		s.persistState()
 	}
 	return nil
 }
 
-// buildHTTPClient returns an HTTP client and base URL for the Slicer API.
-// If the URL looks like a Unix socket path, it returns a client that dials
-// the socket and a dummy HTTP base URL.
-func buildHTTPClient(rawURL string) (*http.Client, string) {
+// persistState saves the state cache if persist_state is set.
+func (s *SlicerVM) persistState() {
+	if s.PersistState == "" {
+		return
+	}
+	if err := s.stateMgr.saveState(s.PersistState); err != nil {
+		s.logger.Warn("saving persisted state", zap.String("key", s.PersistState), zap.Error(err))
+	}
+}
+
+// cleanupDrainTimeout bounds how long Cleanup waits for wakes in progress.
+const cleanupDrainTimeout = 5 * time.Second
+
+// storageValuePrefix marks a config value that should be read from Caddy's
+// storage rather than used literally.
+const storageValuePrefix = "storage:"
+
+// resolveStorageValue returns value unchanged unless it starts with
+// "storage:", in which case the rest is treated as a key and loaded from
+// the storage module configured for this Caddy instance.
+func resolveStorageValue(ctx caddy.Context, field, value string) (string, error) {
+	key, ok := strings.CutPrefix(value, storageValuePrefix)
+	if !ok {
+		return value, nil
+	}
+	if key == "" {
+		return "", fmt.Errorf("%s: storage key is empty", field)
+	}
+
+	data, err := ctx.Storage().Load(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("%s: loading storage key %q: %w", field, key, err)
+	}
+
+	resolved := strings.TrimSpace(string(data))
+	if resolved == "" {
+		return "", fmt.Errorf("%s: storage key %q has no value", field, key)
+	}
+	return resolved, nil
+}
+
+// buildHTTPClient returns an HTTP client, whose requests time out after
+// timeout if it is positive, and base URL for the Slicer API. A unix://
+// URL, or for compatibility anything without an http(s) scheme, is a Unix
+// socket path: the client dials the socket and the base URL is a dummy.
+// Relative paths are resolved against the working directory, and the
+// socket must exist.
+func buildHTTPClient(rawURL string, timeout time.Duration) (*http.Client, string, error) {
+	timeout = max(timeout, 0)
 	if strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://") {
-		return nil, rawURL
+		return &http.Client{Timeout: timeout}, rawURL, nil
 	}
 
-	// Treat as Unix socket path
-	sockPath := rawURL
+	sockPath, explicit := strings.CutPrefix(rawURL, "unix://")
 	if strings.HasPrefix(sockPath, "~/") {
 		home, _ := os.UserHomeDir()
 		sockPath = home + sockPath[1:]
 	}
+	sockPath, err := filepath.Abs(sockPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("slicer_url: resolving socket path: %w", err)
+	}
+	fi, err := os.Stat(sockPath)
+	if err != nil {
+		if !explicit {
+			return nil, "", fmt.Errorf("slicer_url: %w (use http:// or https:// for a TCP address)", err)
+		}
+		return nil, "", fmt.Errorf("slicer_url: %w", err)
+	}
+	if fi.Mode().Type() != os.ModeSocket {
+		return nil, "", fmt.Errorf("slicer_url: %s is not a Unix socket", sockPath)
+	}
 
 	return &http.Client{
+		Timeout: timeout,
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 				return net.Dial("unix", sockPath)
 			},
 		},
-	}, "http://localhost"
+	}, "http://localhost", nil
+}
+
+// validVarName reports whether name can be read back as the placeholder
+// {http.vars.<name>}.
+func validVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// hostGroups returns HostGroup followed by HostGroups, without duplicates.
+func (s *SlicerVM) hostGroups() []string {
+	var groups []string
+	for _, group := range append([]string{s.HostGroup}, s.HostGroups...) {
+		if group != "" && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// slicerCallTimeout returns SlicerTimeout if it is set, or def.
+func (s *SlicerVM) slicerCallTimeout(def time.Duration) time.Duration {
+	if s.SlicerTimeout > 0 {
+		return time.Duration(s.SlicerTimeout)
+	}
+	return def
+}
+
+// suspends reports whether idle VMs may be suspended to disk, and so need
+// RestoreVM to wake.
+func (s *SlicerVM) suspends() bool {
+	return s.PauseMode == pauseModeSuspend || s.DeepIdleTimeout > 0
 }
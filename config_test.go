@@ -0,0 +1,41 @@
+package caddyrelightslicervm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestValidateWakeTimeoutAndWatchInterval(t *testing.T) {
+	tests := []struct {
+		cfg     string
+		wantErr string
+	}{
+		{cfg: "wake_timeout -1s", wantErr: "wake_timeout must be between 0 and 10m"},
+		{cfg: "wake_timeout 0"},
+		{cfg: "wake_timeout 10m"},
+		{cfg: "wake_timeout 10m1ns", wantErr: "wake_timeout must be between 0 and 10m"},
+		{cfg: "watch_interval -1s", wantErr: "watch_interval must be at least 1s"},
+		{cfg: "watch_interval 0"},
+		{cfg: "watch_interval 999ms", wantErr: "watch_interval must be at least 1s"},
+		{cfg: "watch_interval 1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg, func(t *testing.T) {
+			rs, err := provisionTestHandler(t, newFakeSlicer(t), tt.cfg)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			case strings.HasSuffix(tt.cfg, " 0"):
+				if rs.WakeTimeout != caddy.Duration(30*time.Second) || rs.WatchInterval != caddy.Duration(30*time.Second) {
+					t.Fatalf("zero not defaulted: wake_timeout %v, watch_interval %v",
+						time.Duration(rs.WakeTimeout), time.Duration(rs.WatchInterval))
+				}
+			}
+		})
+	}
+}
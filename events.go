@@ -0,0 +1,27 @@
+package caddyrelightslicervm
+
+// VM lifecycle events emitted through Caddy's events app. Each carries the
+// app name, the VM hostname and the host group; vm_paused adds the pause
+// reason and vm_wake_failed the error.
+const (
+	eventVMWaking     = "vm_waking"
+	eventVMRunning    = "vm_running"
+	eventVMPaused     = "vm_paused"
+	eventVMWakeFailed = "vm_wake_failed"
+)
+
+// emit sends a lifecycle event for appName. It must not be called with m.mu
+// held, since event handlers (such as this module's own) may call back
+// into the state manager.
+func (m *vmStateManager) emit(name, appName, hostname string, data map[string]any) {
+	if m.events == nil {
+		return
+	}
+	if data == nil {
+		data = make(map[string]any, 3)
+	}
+	data["app"] = appName
+	data["hostname"] = hostname
+	data["host_group"] = m.hostGroup
+	m.events.Emit(m.caddyCtx, name, data)
+}
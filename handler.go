@@ -1,41 +1,162 @@
 package caddyrelightslicervm
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
 )
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (rs *SlicerVM) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	hostname := extractHostname(r)
+	if rs.maintenance.Load() {
+		rs.respondMaintenance(w, "", rs.MaintenanceMessage)
+		return nil
+	}
+
+	hostname := rs.requestHostname(r)
+	switch rs.RouteMode {
+	case routeModeHost:
+		if len(rs.DomainSuffixes) > 0 {
+			app, ok := rs.stripDomainSuffix(hostname)
+			if !ok {
+				http.Error(w, fmt.Sprintf("hostname %q is not under a configured domain suffix", hostname),
+					http.StatusBadRequest)
+				return nil
+			}
+			hostname = app
+		}
+		if rs.AppLabelIndex > 0 {
+			label, ok := hostLabel(hostname, rs.AppLabelIndex)
+			if !ok {
+				http.Error(w, fmt.Sprintf("hostname %q has no label at index %d", hostname, rs.AppLabelIndex),
+					http.StatusBadRequest)
+				return nil
+			}
+			hostname = label
+		}
+	case routeModePath:
+		hostname = pathApp(r)
+	case routeModeSubdomainPath:
+		hostname = subdomainPathApp(r, hostname)
+	}
+	if rs.AppClaim != "" {
+		app, status, err := rs.appFromClaim(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return nil
+		}
+		hostname = app
+	}
 	if hostname == "" {
 		http.Error(w, "could not determine hostname", http.StatusBadRequest)
 		return nil
 	}
 
+	if rn := rs.reservedName(hostname); rn != nil {
+		switch rn.Action {
+		case reservedNotFound:
+			if rs.passthroughNotFound(hostname) {
+				return next.ServeHTTP(w, r)
+			}
+			rs.respondNotFound(w, r, hostname)
+			return nil
+		case reservedUpstream:
+			caddyhttp.SetVar(r.Context(), rs.UpstreamVar, rn.Upstream)
+			return next.ServeHTTP(w, r)
+		case reservedApp:
+			hostname = rn.App
+		}
+	}
+
+	hostname = rs.canonicalApp(hostname)
+
+	if msg, ok := rs.appMaintenance(r.Context(), hostname); ok {
+		rs.respondMaintenance(w, hostname, msg)
+		return nil
+	}
+
+	if len(rs.wakeBypass) > 0 {
+		bypass, err := rs.wakeBypass.AnyMatchWithError(r)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		if bypass {
+			return rs.serveWithoutWake(w, r, next, hostname)
+		}
+	}
+
+	if rs.ColdStartRedirect != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if _, running, err := rs.stateMgr.runningIP(r.Context(), hostname); err == nil && !running {
+			go rs.wakeInBackground(hostname)
+			http.Redirect(w, r, rs.coldStartLocation(r, hostname), http.StatusFound)
+			return nil
+		}
+	}
+
+	rs.continueEarly(w, r, hostname)
+
+	// With debug_headers, note whether this request has to wait for a wake.
+	coldStart := false
+	if rs.DebugHeaders {
+		_, running, err := rs.stateMgr.runningIP(r.Context(), hostname)
+		coldStart = err == nil && !running
+	}
+	wakeStart := time.Now()
+
 	// Block until VM is running (fast - SlicerVM resume is sub-second)
-	ip, err := rs.stateMgr.ensureRunning(r.Context(), hostname, time.Duration(rs.WakeTimeout))
+	ip, err := rs.wakeAndBuffer(r, hostname)
+	// Record the request, and with it activity, before an idle pause can
+	// take the VM away; one that began since the wake is waited out and
+	// the VM woken again.
+	for err == nil && !rs.stateMgr.beginRequest(hostname) {
+		ip, err = rs.stateMgr.ensureRunning(r.Context(), hostname, rs.requestWakeTimeout())
+	}
+	if isNotFound(err) && rs.passthroughNotFound(hostname) {
+		return next.ServeHTTP(w, r)
+	}
 	if err != nil {
 		rs.logger.Error("failed to ensure VM running", zap.String("domain", hostname), zap.Error(err))
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, fmt.Sprintf("app for %q not found", hostname), http.StatusNotFound)
-			return nil
-		}
-		w.Header().Set("Retry-After", "5")
-		http.Error(w, fmt.Sprintf("app for %q is starting up, please retry", hostname), http.StatusServiceUnavailable)
+		rs.respondWakeError(w, r, hostname, err)
 		return nil
 	}
+	defer func() {
+		if rs.stateMgr.endRequest(hostname) == 0 && rs.pauseAfterRequest(hostname) {
+			go rs.pauseAfterServe(hostname)
+		}
+	}()
+
+	if coldStart {
+		setWakeHeaders(w, time.Since(wakeStart))
+	}
 
-	// VM is running - record activity and set upstream for reverse_proxy
-	rs.stateMgr.touchLastSeen(hostname)
+	if rs.useFallback(r, hostname, ip) {
+		return next.ServeHTTP(w, r)
+	}
 
-	upstream := fmt.Sprintf("%s:%d", ip, rs.AppPort)
-	caddyhttp.SetVar(r.Context(), "relight_slicervm_upstream", upstream)
+	// VM is running - set upstream for reverse_proxy
+	host, err := rs.upstreamHost(r.Context(), hostname, ip)
+	if err != nil {
+		rs.logger.Error("failed to resolve upstream", zap.String("domain", hostname), zap.Error(err))
+		http.Error(w, fmt.Sprintf("app for %q is unavailable", hostname), http.StatusBadGateway)
+		return nil
+	}
+	upstream := rs.setUpstream(r, hostname, host)
 
 	rs.logger.Debug("proxying request",
 		zap.String("domain", hostname),
@@ -46,18 +167,611 @@ func (rs *SlicerVM) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 	return next.ServeHTTP(w, r)
 }
 
+// respondWakeError writes the response for a request whose VM could not be
+// made ready.
+func (rs *SlicerVM) respondWakeError(w http.ResponseWriter, r *http.Request, hostname string, err error) {
+	if isNotFound(err) {
+		rs.respondNotFound(w, r, hostname)
+		return
+	}
+	if errors.Is(err, errMaintenance) {
+		rs.respondMaintenance(w, hostname, rs.MaintenanceMessage)
+		return
+	}
+
+	retryAfter := rs.retryAfter(hostname)
+	state := stateWaking
+	msg := fmt.Sprintf("app for %q is starting up, please retry", hostname)
+
+	var cooldown *cooldownError
+	var shed *shedError
+	var unavailable *unavailableError
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		msg = fmt.Sprintf("app for %q is starting up and the request body is too large to hold, please retry", hostname)
+	case errors.As(err, &cooldown):
+		retryAfter = int(math.Ceil(cooldown.remaining.Seconds()))
+		state = stateCooldown
+		msg = fmt.Sprintf("app for %q failed to start recently, please retry later", hostname)
+	case errors.As(err, &shed):
+		retryAfter = 10
+		state = stateShed
+		msg = fmt.Sprintf("app for %q cannot start right now, please retry later", hostname)
+	case errors.As(err, &unavailable):
+		retryAfter = 30
+		state = stateFailed
+		msg = fmt.Sprintf("app for %q is unavailable, its VM is %s", hostname, unavailable.status)
+	case rs.stateMgr.statusOf(hostname) != statusWaking:
+		state = stateFailed
+		msg = fmt.Sprintf("app for %q failed to start, please retry later", hostname)
+	}
+
+	status := http.StatusServiceUnavailable
+	if resp := rs.WakeErrors[state]; resp != nil {
+		if resp.StatusCode != 0 {
+			status = resp.StatusCode
+		}
+		if resp.Body != "" {
+			repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			if repl == nil {
+				repl = caddy.NewReplacer()
+			}
+			msg = repl.ReplaceAll(resp.Body, "")
+		}
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if rs.ColdStartHeaders {
+		w.Header().Set("X-Slicer-App", hostname)
+		w.Header().Set("X-Slicer-State", state)
+		w.Header().Set("X-Slicer-Poll-Ms", strconv.FormatInt(time.Duration(rs.ColdStartPollInterval).Milliseconds(), 10))
+	}
+	if rs.writeWaitingPage(w, status, waitingPageData{App: hostname, RetryAfter: retryAfter, State: state, Message: msg}) {
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// retryAfter returns the Retry-After seconds for a request whose app is
+// still starting up.
+func (rs *SlicerVM) retryAfter(hostname string) int {
+	d := time.Duration(rs.RetryAfter)
+	if rs.RetryAfterAdaptive {
+		if remaining, ok := rs.stateMgr.expectedWakeRemaining(hostname); ok {
+			d = remaining
+		}
+	}
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// respondMaintenance refuses a request for hostname, or for any app if
+// hostname is empty, with maintenance message msg.
+func (rs *SlicerVM) respondMaintenance(w http.ResponseWriter, hostname, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(rs.retryAfter(hostname)))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// setWakeHeaders records on the response that the request waited d for its
+// VM to wake.
+func setWakeHeaders(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("X-Slicer-Cold-Start", "true")
+	w.Header().Set("X-Slicer-Wake-Duration", d.Round(time.Millisecond).String())
+	w.Header().Add("Server-Timing", fmt.Sprintf("slicervm-wake;dur=%.1f", float64(d.Microseconds())/1000))
+}
+
+// coldStartLocation returns the cold_start_redirect URL for a request to
+// appName, carrying the app name and the original request URL.
+func (rs *SlicerVM) coldStartLocation(r *http.Request, appName string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	original := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+
+	// Already validated as an absolute URL.
+	u, _ := url.Parse(rs.ColdStartRedirect)
+	q := u.Query()
+	q.Set("app", appName)
+	q.Set("url", original.String())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// wakeInBackground wakes appName without a waiting request, as for a client
+// sent to the cold_start_redirect page.
+func (rs *SlicerVM) wakeInBackground(appName string) {
+	timeout := time.Duration(rs.WakeTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if _, err := rs.stateMgr.ensureRunning(ctx, appName, timeout); err != nil {
+		rs.logger.Error("background wake failed", zap.String("domain", appName), zap.Error(err))
+		return
+	}
+	rs.stateMgr.touchLastSeen(appName)
+}
+
+// errBodyTooLarge is returned when a cold request's body exceeds
+// cold_start_buffer_limit.
+var errBodyTooLarge = errors.New("request body exceeds cold_start_buffer_limit")
+
+// wakeAndBuffer ensures hostname's VM is running. With
+// cold_start_buffer_limit or max_buffered_body, a cold request's body is
+// read into memory while the VM wakes, rather than left unread until it is
+// ready.
+func (rs *SlicerVM) wakeAndBuffer(r *http.Request, hostname string) (string, error) {
+	timeout := rs.requestWakeTimeout()
+	limit := max(rs.ColdStartBufferLimit, rs.MaxBufferedBody)
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return rs.stateMgr.ensureRunning(r.Context(), hostname, timeout)
+	}
+	if rs.MaxBufferedBody > 0 && r.ContentLength > limit {
+		// Too large to buffer; stream it after the wake as usual.
+		return rs.stateMgr.ensureRunning(r.Context(), hostname, timeout)
+	}
+	if _, running, err := rs.stateMgr.runningIP(r.Context(), hostname); err != nil || running {
+		return rs.stateMgr.ensureRunning(r.Context(), hostname, timeout)
+	}
+
+	type result struct {
+		ip  string
+		err error
+	}
+	woke := make(chan result, 1)
+	go func() {
+		ip, err := rs.stateMgr.ensureRunning(r.Context(), hostname, timeout)
+		woke <- result{ip, err}
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("buffering request body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		if rs.ColdStartBufferLimit > 0 {
+			return "", errBodyTooLarge
+		}
+		// Put back what was read and stream the rest after the wake.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		res := <-woke
+		return res.ip, res.err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	res := <-woke
+	return res.ip, res.err
+}
+
+// requestWakeTimeout returns how long a request waits for its app to wake.
+// With fast_fail_after the request gives up waiting early; the wake itself
+// is not tied to the request and keeps going.
+func (rs *SlicerVM) requestWakeTimeout() time.Duration {
+	if rs.FastFailAfter > 0 {
+		return time.Duration(rs.FastFailAfter)
+	}
+	return time.Duration(rs.WakeTimeout)
+}
+
+// Values of the X-Slicer-State cold start header.
+const (
+	stateWaking   = "waking"
+	stateFailed   = "failed"
+	stateCooldown = "cooldown"
+	stateShed     = "shed"
+)
+
+// continueEarly sends the interim "100 Continue" for requests that carry
+// "Expect: 100-continue" when the VM is not yet running. Go only sends it
+// once the body is first read, which would be after the wake completes, so
+// clients uploading large bodies could give up while waiting for it.
+func (rs *SlicerVM) continueEarly(w http.ResponseWriter, r *http.Request, hostname string) {
+	if rs.ExpectContinue != expectContinueEarly || !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return
+	}
+	if _, running, err := rs.stateMgr.runningIP(r.Context(), hostname); err != nil || running {
+		return
+	}
+	w.WriteHeader(http.StatusContinue)
+}
+
+// pauseAfterRequest reports whether appName is configured to be paused as
+// soon as it has no requests in flight.
+func (rs *SlicerVM) pauseAfterRequest(appName string) bool {
+	label := firstLabel(appName)
+	for _, name := range rs.PauseAfterRequest {
+		if name == appName || name == label {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseAfterServe pauses a pause_after_request app once its last in-flight
+// request has completed. beginPause rechecks for requests under the state
+// lock, so one that arrived in the meantime keeps the VM running. Nothing
+// is paused in maintenance mode, and a pause still running when the handler
+// is cleaned up is cancelled.
+func (rs *SlicerVM) pauseAfterServe(appName string) {
+	if rs.maintenance.Load() {
+		return
+	}
+	pauseApp(rs.stateMgr.ctx, rs, appName, "request completed", 0)
+}
+
+// serveWithoutWake proxies wake_bypass traffic only if the VM is already
+// running. It never resumes a paused VM and never records activity, so
+// this traffic cannot keep an app warm.
+func (rs *SlicerVM) serveWithoutWake(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, hostname string) error {
+	ip, running, err := rs.stateMgr.runningIP(r.Context(), hostname)
+	if err != nil {
+		rs.logger.Error("failed to look up VM", zap.String("domain", hostname), zap.Error(err))
+		if isNotFound(err) {
+			if rs.passthroughNotFound(hostname) {
+				return next.ServeHTTP(w, r)
+			}
+			rs.respondNotFound(w, r, hostname)
+			return nil
+		}
+		http.Error(w, fmt.Sprintf("app for %q is unavailable", hostname), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if !running {
+		rs.logger.Debug("wake bypassed for paused VM", zap.String("domain", hostname))
+		w.Header().Set("Retry-After", strconv.Itoa(rs.retryAfter(hostname)))
+		http.Error(w, fmt.Sprintf("app for %q is paused", hostname), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if rs.useFallback(r, hostname, ip) {
+		return next.ServeHTTP(w, r)
+	}
+
+	host, err := rs.upstreamHost(r.Context(), hostname, ip)
+	if err != nil {
+		rs.logger.Error("failed to resolve upstream", zap.String("domain", hostname), zap.Error(err))
+		http.Error(w, fmt.Sprintf("app for %q is unavailable", hostname), http.StatusBadGateway)
+		return nil
+	}
+	rs.setUpstream(r, hostname, host)
+
+	return next.ServeHTTP(w, r)
+}
+
+// upstreamHost returns the host to proxy appName to: the VM's IP, or with
+// upstream_target hostname, the VM hostname resolved through DNS. If
+// resolution fails, a recent enough earlier answer is used instead.
+func (rs *SlicerVM) upstreamHost(ctx context.Context, appName, ip string) (string, error) {
+	vmHostname, nodeIP := rs.stateMgr.upstreamNode(appName)
+	if nodeIP != "" {
+		ip = nodeIP
+	}
+	if rs.upstreamTarget(appName) == upstreamTargetIP {
+		if ip == "" {
+			return "", fmt.Errorf("app %q: VM has no IP", appName)
+		}
+		return ip, nil
+	}
+
+	if vmHostname == "" {
+		return "", fmt.Errorf("app %q: VM has no hostname", appName)
+	}
+	resolved, stale, err := rs.resolver.resolve(ctx, vmHostname)
+	if stale {
+		rs.logger.Warn("serving from stale upstream resolution",
+			zap.String("app", appName),
+			zap.String("hostname", vmHostname),
+			zap.String("ip", resolved),
+			zap.Error(err),
+		)
+		return resolved, nil
+	}
+	return resolved, err
+}
+
+// setUpstream sets the reverse_proxy vars for appName at host, on the app's
+// effective port, and returns the upstream address.
+func (rs *SlicerVM) setUpstream(r *http.Request, appName, host string) string {
+	upstream := fmt.Sprintf("%s:%d", host, rs.stateMgr.portFor(appName))
+	caddyhttp.SetVar(r.Context(), rs.UpstreamVar, upstream)
+	caddyhttp.SetVar(r.Context(), rs.UpstreamVar+"_scheme", rs.UpstreamScheme)
+	caddyhttp.SetVar(r.Context(), rs.UpstreamVar+"_url", rs.UpstreamScheme+"://"+upstream)
+	caddyhttp.SetVar(r.Context(), rs.UpstreamVar+"_proto", rs.UpstreamProto)
+	if rs.ForwardClientIP {
+		rs.setClientIPHeaders(r)
+	}
+	return upstream
+}
+
+// setClientIPHeaders stamps X-Forwarded-For and X-Real-IP with the client's
+// address. With trust_forwarded_for, a trusted proxy's X-Forwarded-For is
+// left as sent and X-Real-IP taken from its first entry; reverse_proxy
+// appends the proxy's own address itself. From anyone else both headers are
+// replaced, so clients cannot spoof them.
+func (rs *SlicerVM) setClientIPHeaders(r *http.Request) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	if rs.TrustForwardedFor {
+		trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+		if prior := strings.Join(r.Header.Values("X-Forwarded-For"), ", "); trusted && prior != "" {
+			first, _, _ := strings.Cut(prior, ",")
+			r.Header.Set("X-Real-IP", strings.TrimSpace(first))
+			return
+		}
+	}
+	r.Header.Set("X-Forwarded-For", peer)
+	r.Header.Set("X-Real-IP", peer)
+}
+
+// useFallback points the request at fallback_upstream, and reports true,
+// when the VM at ip has been reported unhealthy.
+func (rs *SlicerVM) useFallback(r *http.Request, hostname, ip string) bool {
+	if rs.FallbackUpstream == "" || !rs.stateMgr.isUnhealthy(ip) {
+		return false
+	}
+	rs.logger.Debug("VM unhealthy, proxying to fallback",
+		zap.String("domain", hostname),
+		zap.String("ip", ip),
+		zap.String("upstream", rs.FallbackUpstream),
+	)
+	caddyhttp.SetVar(r.Context(), rs.UpstreamVar, rs.FallbackUpstream)
+	return true
+}
+
+// upstreamTarget returns the upstream target for appName, trying the full
+// name before its first label and falling back to upstream_target.
+func (rs *SlicerVM) upstreamTarget(appName string) string {
+	if target, ok := rs.AppUpstreamTargets[appName]; ok {
+		return target
+	}
+	if target, ok := rs.AppUpstreamTargets[firstLabel(appName)]; ok {
+		return target
+	}
+	return rs.UpstreamTarget
+}
+
+// respondNotFound writes the response for an app with no matching VM, using
+// the first not_found rule matching the app name, or a plain 404.
+func (rs *SlicerVM) respondNotFound(w http.ResponseWriter, r *http.Request, hostname string) {
+	rule := rs.notFoundRule(hostname)
+	if rule == nil {
+		http.Error(w, fmt.Sprintf("app for %q not found", hostname), http.StatusNotFound)
+		return
+	}
+	if rule.Location != "" {
+		http.Redirect(w, r, rule.Location, rule.StatusCode)
+		return
+	}
+	body := rule.Body
+	if body == "" {
+		body = fmt.Sprintf("app for %q not found", hostname)
+	}
+	http.Error(w, body, rule.StatusCode)
+}
+
+// notFoundRule returns the first not_found rule matching hostname or its
+// first label, or nil.
+func (rs *SlicerVM) notFoundRule(hostname string) *NotFoundRule {
+	label := firstLabel(hostname)
+	for _, rule := range rs.NotFoundRules {
+		if matchAppPattern(rule.Pattern, hostname) || (label != "" && matchAppPattern(rule.Pattern, label)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// passthroughNotFound reports whether a request for the unknown app
+// hostname should go to the next handler, untouched, instead of getting a
+// not-found response. not_found rules still take precedence.
+func (rs *SlicerVM) passthroughNotFound(hostname string) bool {
+	return rs.NotFoundAction == notFoundActionPassthrough && rs.notFoundRule(hostname) == nil
+}
+
+// matchAppPattern reports whether name matches the shell-style glob pattern.
+func matchAppPattern(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// canonicalApp resolves aliases, so that every alias of an app shares one
+// cache entry and therefore one wake, one idle timer and one pause. The full
+// hostname is tried before its first label.
+func (rs *SlicerVM) canonicalApp(hostname string) string {
+	if len(rs.Aliases) == 0 {
+		return hostname
+	}
+	if canonical, ok := rs.Aliases[hostname]; ok {
+		return canonical
+	}
+	if canonical, ok := rs.Aliases[firstLabel(hostname)]; ok {
+		return canonical
+	}
+	return hostname
+}
+
+// reservedName returns the reserved name entry matching hostname, trying the
+// full hostname before its first label, or nil if it is not reserved.
+func (rs *SlicerVM) reservedName(hostname string) *ReservedName {
+	if len(rs.ReservedNames) == 0 {
+		return nil
+	}
+	if rn, ok := rs.ReservedNames[hostname]; ok {
+		return rn
+	}
+	if label := firstLabel(hostname); label != "" {
+		return rs.ReservedNames[label]
+	}
+	return nil
+}
+
+// firstLabel returns the first dot-separated label of hostname, or "" if
+// hostname has no dot.
+func firstLabel(hostname string) string {
+	if idx := strings.Index(hostname, "."); idx > 0 {
+		return hostname[:idx]
+	}
+	return ""
+}
+
+// stripDomainSuffix returns the leftmost label of hostname left after
+// removing the first matching DomainSuffixes entry, or false if hostname is
+// not a subdomain of any of them.
+func (rs *SlicerVM) stripDomainSuffix(hostname string) (string, bool) {
+	for _, suffix := range rs.DomainSuffixes {
+		if rest, ok := strings.CutSuffix(hostname, "."+suffix); ok && rest != "" {
+			label, _, _ := strings.Cut(rest, ".")
+			return label, label != ""
+		}
+	}
+	return "", false
+}
+
+// hostLabel returns the dot-separated label of hostname at index, or false
+// if hostname has too few labels.
+func hostLabel(hostname string, index int) (string, bool) {
+	labels := strings.Split(hostname, ".")
+	if index >= len(labels) || labels[index] == "" {
+		return "", false
+	}
+	return labels[index], true
+}
+
+// appFromClaim reads the app name from the AppClaim claim of the bearer
+// token on the request. The token signature is not verified; that is left
+// to an authentication layer in front of this handler. On failure it
+// returns the HTTP status to respond with.
+func (rs *SlicerVM) appFromClaim(r *http.Request) (string, int, error) {
+	header := rs.AppClaimHeader
+	if header == "" {
+		header = "Authorization"
+	}
+
+	token := strings.TrimSpace(r.Header.Get(header))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return "", http.StatusUnauthorized, fmt.Errorf("missing token in %s header", header)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", http.StatusBadRequest, fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("malformed token payload")
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("malformed token claims")
+	}
+	app, _ := claims[rs.AppClaim].(string)
+	if app == "" {
+		return "", http.StatusBadRequest, fmt.Errorf("token has no %q claim", rs.AppClaim)
+	}
+	return app, 0, nil
+}
+
+// subdomainPathApp returns the app name for route_mode subdomain_path,
+// "<first label>/<first path segment>", and strips that segment from the
+// request path. Trailing slashes and deeper paths do not change the name,
+// so every request to one app shares one cache entry. It returns "" if
+// the request has no path segment.
+func subdomainPathApp(r *http.Request, hostname string) string {
+	label := firstLabel(hostname)
+	if label == "" {
+		label = hostname
+	}
+	if label == "" {
+		return ""
+	}
+	segment := pathApp(r)
+	if segment == "" {
+		return ""
+	}
+	return label + "/" + segment
+}
+
+// pathApp returns the first path segment of r as the app name and strips
+// it from the request path, so the upstream sees the rest. It returns ""
+// for requests to the root path.
+func pathApp(r *http.Request) string {
+	segment, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if segment == "" {
+		return ""
+	}
+
+	r.URL.Path = "/" + rest
+	if r.URL.RawPath != "" {
+		_, rawRest, _ := strings.Cut(strings.TrimPrefix(r.URL.RawPath, "/"), "/")
+		r.URL.RawPath = "/" + rawRest
+	}
+	return segment
+}
+
 // extractHostname returns the hostname from the request, stripped of port.
 // Used as the lookup key for VM tag matching.
 func extractHostname(r *http.Request) string {
-	host := r.Host
+	return stripPort(r.Host)
+}
 
-	// Strip port if present
+// requestHostname returns the normalized hostname the app name is derived
+// from. With trust_forwarded_host, a request from one of the server's
+// trusted_proxies that carries X-Forwarded-Host is routed by that header
+// instead of Host.
+func (rs *SlicerVM) requestHostname(r *http.Request) string {
+	if rs.TrustForwardedHost {
+		if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); trusted {
+			if host := forwardedHost(r); host != "" {
+				return normalizeHostname(host)
+			}
+		}
+	}
+	return normalizeHostname(extractHostname(r))
+}
+
+// normalizeHostname lowercases hostname and drops the trailing dot of a
+// fully qualified name, so MyApp.example.com. and myapp.example.com name
+// the same app.
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
+
+// forwardedHost returns the original host from X-Forwarded-Host, stripped
+// of port. Proxies append to the header, either in one comma-separated
+// value or as repeated headers, so the first entry is the client's.
+func forwardedHost(r *http.Request) string {
+	for _, value := range r.Header.Values("X-Forwarded-Host") {
+		first, _, _ := strings.Cut(value, ",")
+		if host := stripPort(strings.TrimSpace(first)); host != "" {
+			return host
+		}
+	}
+	return ""
+}
+
+// stripPort removes a trailing port from host, leaving IPv6 addresses intact.
+func stripPort(host string) string {
 	if idx := strings.LastIndex(host, ":"); idx != -1 {
 		// Make sure this isn't part of an IPv6 address
 		if !strings.Contains(host, "]") || strings.LastIndex(host, "]") < idx {
 			host = host[:idx]
 		}
 	}
-
 	return host
 }
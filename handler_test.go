@@ -0,0 +1,427 @@
+package caddyrelightslicervm
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestPauseAfterRequest(t *testing.T) {
+	t.Run("paused once served", func(t *testing.T) {
+		f := newFakeSlicer(t)
+		rs := newTestHandler(t, f, "pause_after_request myapp\nidle_timeout 1h")
+
+		rec, _ := serveTest(rs, httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		eventually(t, 2*time.Second, func() bool { return f.count(http.MethodPost, "/vm/apps-1/pause") == 1 })
+		eventually(t, time.Second, func() bool { return rs.stateMgr.statusOf("myapp.example.com") == statusPaused })
+	})
+
+	t.Run("not paused in maintenance", func(t *testing.T) {
+		f := newFakeSlicer(t)
+		rs := newTestHandler(t, f, "pause_after_request myapp\nidle_timeout 1h")
+
+		if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp.example.com", time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		rs.maintenance.Store(true)
+		rs.pauseAfterServe("myapp.example.com")
+		if n := f.count(http.MethodPost, "/vm/apps-1/pause"); n != 0 {
+			t.Fatalf("paused %d times in maintenance", n)
+		}
+	})
+
+	t.Run("request in flight", func(t *testing.T) {
+		f := newFakeSlicer(t)
+		rs := newTestHandler(t, f, "pause_after_request myapp\nidle_timeout 1h")
+		if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp.example.com", time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		if !rs.stateMgr.beginRequest("myapp.example.com") {
+			t.Fatal("beginRequest refused a running VM")
+		}
+		rs.pauseAfterServe("myapp.example.com")
+		if n := f.count(http.MethodPost, "/vm/apps-1/pause"); n != 0 {
+			t.Fatalf("paused %d times with a request in flight", n)
+		}
+		rs.stateMgr.endRequest("myapp.example.com")
+		rs.pauseAfterServe("myapp.example.com")
+		if n := f.count(http.MethodPost, "/vm/apps-1/pause"); n != 1 {
+			t.Fatalf("paused %d times once idle, want 1", n)
+		}
+	})
+}
+
+func TestSetClientIPHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		trustXFF    bool
+		trustedPeer bool
+		xff         []string
+		wantXFF     string
+		wantRealIP  string
+	}{
+		{name: "direct", wantXFF: "203.0.113.7", wantRealIP: "203.0.113.7"},
+		{name: "direct spoofed", xff: []string{"1.1.1.1"}, wantXFF: "203.0.113.7", wantRealIP: "203.0.113.7"},
+		{name: "proxied, not trusted", trustXFF: true, xff: []string{"1.1.1.1"}, wantXFF: "203.0.113.7", wantRealIP: "203.0.113.7"},
+		{name: "proxied, trust off", trustedPeer: true, xff: []string{"198.51.100.1"}, wantXFF: "203.0.113.7", wantRealIP: "203.0.113.7"},
+		// reverse_proxy appends the proxy's address, so it is not added here.
+		{name: "proxied", trustXFF: true, trustedPeer: true, xff: []string{"198.51.100.1"},
+			wantXFF: "198.51.100.1", wantRealIP: "198.51.100.1"},
+		{name: "proxied twice", trustXFF: true, trustedPeer: true, xff: []string{"198.51.100.1, 10.0.0.1"},
+			wantXFF: "198.51.100.1, 10.0.0.1", wantRealIP: "198.51.100.1"},
+		{name: "proxied, several headers", trustXFF: true, trustedPeer: true, xff: []string{"198.51.100.1", "10.0.0.1"},
+			wantXFF: "198.51.100.1, 10.0.0.1", wantRealIP: "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &SlicerVM{ForwardClientIP: true, TrustForwardedFor: tt.trustXFF}
+			r := withCaddyContext(httptest.NewRequest(http.MethodGet, "http://myapp/", nil))
+			r.RemoteAddr = "203.0.113.7:4321"
+			caddyhttp.SetVar(r.Context(), caddyhttp.TrustedProxyVarKey, tt.trustedPeer)
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			rs.setClientIPHeaders(r)
+			if got := strings.Join(r.Header.Values("X-Forwarded-For"), ", "); got != tt.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", got, tt.wantXFF)
+			}
+			if got := r.Header.Get("X-Real-IP"); got != tt.wantRealIP {
+				t.Errorf("X-Real-IP = %q, want %q", got, tt.wantRealIP)
+			}
+		})
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"myapp.example.com", "myapp.example.com"},
+		{"MyApp.Example.COM", "myapp.example.com"},
+		{"myapp.example.com.", "myapp.example.com"},
+		{"MYAPP.EXAMPLE.COM.", "myapp.example.com"},
+		{"myapp", "myapp"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeHostname(tt.in); got != tt.want {
+			t.Errorf("normalizeHostname(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRequestHostnameNormalized(t *testing.T) {
+	// The app name is taken from requestHostname, so every spelling of a
+	// host must map to the same name.
+	tests := []struct {
+		host, want string
+	}{
+		{"myapp.example.com", "myapp.example.com"},
+		{"MyApp.Example.com:8443", "myapp.example.com"},
+		{"myapp.example.com.", "myapp.example.com"},
+		{"MYAPP.example.com.:80", "myapp.example.com"},
+		{"[::1]:8080", "[::1]"},
+		{"[::1]", "[::1]"},
+	}
+	rs := &SlicerVM{}
+	for _, tt := range tests {
+		r := withCaddyContext(httptest.NewRequest(http.MethodGet, "http://placeholder/", nil))
+		r.Host = tt.host
+		if got := rs.requestHostname(r); got != tt.want {
+			t.Errorf("requestHostname(Host: %q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRequestHostnameForwardedHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		trust   bool
+		trusted bool
+		xfh     []string
+		want    string
+	}{
+		{name: "trusted, single", trust: true, trusted: true, xfh: []string{"MyApp.example.com:443"}, want: "myapp.example.com"},
+		{name: "trusted, comma-separated", trust: true, trusted: true, xfh: []string{"myapp.example.com, proxy.internal"}, want: "myapp.example.com"},
+		{name: "trusted, repeated", trust: true, trusted: true, xfh: []string{"myapp.example.com", "proxy.internal"}, want: "myapp.example.com"},
+		{name: "trusted, empty first", trust: true, trusted: true, xfh: []string{"", "myapp.example.com"}, want: "myapp.example.com"},
+		{name: "trusted, none", trust: true, trusted: true, want: "host.example.com"},
+		{name: "untrusted peer", trust: true, xfh: []string{"myapp.example.com"}, want: "host.example.com"},
+		{name: "option off", trusted: true, xfh: []string{"myapp.example.com"}, want: "host.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &SlicerVM{TrustForwardedHost: tt.trust}
+			r := withCaddyContext(httptest.NewRequest(http.MethodGet, "http://host.example.com/", nil))
+			caddyhttp.SetVar(r.Context(), caddyhttp.TrustedProxyVarKey, tt.trusted)
+			for _, v := range tt.xfh {
+				r.Header.Add("X-Forwarded-Host", v)
+			}
+			if got := rs.requestHostname(r); got != tt.want {
+				t.Errorf("requestHostname = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	f := newFakeSlicer(t)
+	f.addNode("apps-2", "127.0.0.2", "Paused", "marketing")
+	rs := newTestHandler(t, f, `idle_timeout 1h
+reserved_name admin not_found
+reserved_name api upstream 10.0.0.5:8080
+reserved_name www app marketing`)
+
+	calls := len(f.snapshotCalls())
+	rec, _ := serveTest(rs, httptest.NewRequest(http.MethodGet, "http://admin.example.com/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("not_found: status = %d, want 404", rec.Code)
+	}
+
+	rec, upstream := serveTest(rs, httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil))
+	if rec.Code != http.StatusOK || upstream != "10.0.0.5:8080" {
+		t.Errorf("upstream: status = %d, upstream %q, want 200 10.0.0.5:8080", rec.Code, upstream)
+	}
+	if n := len(f.snapshotCalls()); n != calls {
+		t.Errorf("not_found and upstream made %d Slicer calls, want none", n-calls)
+	}
+
+	rec, upstream = serveTest(rs, httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(upstream, "127.0.0.2:") {
+		t.Errorf("app: status = %d, upstream %q, want 200 via the marketing VM", rec.Code, upstream)
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-2/resume"); n != 1 {
+		t.Errorf("app: marketing VM resumed %d times, want 1", n)
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 0 {
+		t.Errorf("app: myapp VM resumed %d times, want 0", n)
+	}
+}
+
+func TestExpectContinueEarly(t *testing.T) {
+	f := newFakeSlicer(t)
+	var mu sync.Mutex
+	var resumed time.Time
+	f.onResume = func(string) (int, string) {
+		time.Sleep(300 * time.Millisecond)
+		mu.Lock()
+		resumed = time.Now()
+		mu.Unlock()
+		return 0, ""
+	}
+	rs := newTestHandler(t, f, "idle_timeout 1h\nexpect_continue early")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			io.Copy(io.Discard, r.Body)
+			return nil
+		})
+		rs.ServeHTTP(w, withCaddyContext(r), next)
+	}))
+	t.Cleanup(srv.Close)
+
+	var got100 time.Time
+	trace := &httptrace.ClientTrace{Got100Continue: func() { got100 = time.Now() }}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(t.Context(), trace),
+		http.MethodPost, srv.URL+"/upload", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "myapp.example.com"
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got100.IsZero() {
+		t.Fatal("no 100 Continue received")
+	}
+	if !got100.Before(resumed) {
+		t.Errorf("100 Continue sent %v after the wake completed", got100.Sub(resumed))
+	}
+}
+
+func TestAliasesShareIdleAccounting(t *testing.T) {
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h\nalias myapp shop.example.com promo")
+
+	for _, host := range []string{"shop.example.com", "promo.example.org", "myapp"} {
+		rec, _ := serveTest(rs, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", host, rec.Code)
+		}
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 1 {
+		t.Errorf("resumed %d times for three names of one app, want 1", n)
+	}
+	rs.stateMgr.mu.Lock()
+	names := slices.Sorted(maps.Keys(rs.stateMgr.vms))
+	served := rs.stateMgr.vms["myapp"].served
+	rs.stateMgr.mu.Unlock()
+	if !slices.Equal(names, []string{"myapp"}) {
+		t.Errorf("cache entries = %q, want only the canonical name", names)
+	}
+	if served != 3 {
+		t.Errorf("canonical entry served %d requests, want 3", served)
+	}
+
+	// Traffic to an alias alone keeps the canonical app from idling out.
+	rs.stateMgr.mu.Lock()
+	rs.stateMgr.vms["myapp"].lastSeen = time.Now().Add(-2 * time.Hour)
+	rs.stateMgr.mu.Unlock()
+	serveTest(rs, httptest.NewRequest(http.MethodGet, "http://shop.example.com/", nil))
+	if idle := rs.stateMgr.idleApps(time.Hour, 1); len(idle) != 0 {
+		t.Errorf("idle apps = %q after alias traffic, want none", idle)
+	}
+}
+
+func TestWakeAndBufferBodies(t *testing.T) {
+	small := strings.Repeat("a", 512)
+	large := strings.Repeat("b", 4096)
+	tests := []struct {
+		name       string
+		cfg        string
+		body       string
+		wantStatus int
+		buffered   bool
+	}{
+		{name: "small, cold_start_buffer_limit", cfg: "cold_start_buffer_limit 1KiB", body: small, wantStatus: http.StatusOK, buffered: true},
+		{name: "large, cold_start_buffer_limit", cfg: "cold_start_buffer_limit 1KiB", body: large, wantStatus: http.StatusServiceUnavailable},
+		{name: "small, max_buffered_body", cfg: "max_buffered_body 1KiB", body: small, wantStatus: http.StatusOK, buffered: true},
+		{name: "large, max_buffered_body", cfg: "max_buffered_body 1KiB", body: large, wantStatus: http.StatusOK},
+		{name: "no limit", body: large, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSlicer(t)
+			f.onResume = func(string) (int, string) {
+				time.Sleep(20 * time.Millisecond)
+				return 0, ""
+			}
+			rs := newTestHandler(t, f, "idle_timeout 1h\n"+tt.cfg)
+
+			var got string
+			var replayable bool
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				got = string(b)
+				replayable = r.GetBody != nil
+				return nil
+			})
+			req := httptest.NewRequest(http.MethodPost, "http://myapp.example.com/upload", strings.NewReader(tt.body))
+			// Unknown length, as for a chunked upload, so the limit is
+			// enforced while reading rather than from Content-Length.
+			req.ContentLength = -1
+			rec := httptest.NewRecorder()
+			if err := rs.ServeHTTP(rec, withCaddyContext(req), next); err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if !strings.Contains(rec.Body.String(), "request body is too large to hold") {
+					t.Errorf("body = %q, want the too-large message", rec.Body.String())
+				}
+				return
+			}
+			if got != tt.body {
+				t.Errorf("upstream got %d bytes, want %d", len(got), len(tt.body))
+			}
+			if replayable != tt.buffered {
+				t.Errorf("GetBody set = %v, want %v", replayable, tt.buffered)
+			}
+		})
+	}
+}
+
+func TestHostLabel(t *testing.T) {
+	tests := []struct {
+		hostname string
+		index    int
+		want     string
+		ok       bool
+	}{
+		{"myapp.example.com", 0, "myapp", true},
+		{"api.myapp.example.com", 1, "myapp", true},
+		{"v2.api.myapp.example.com", 2, "myapp", true},
+		{"myapp.example.com", 2, "com", true},
+		{"myapp.example.com", 3, "", false},
+		{"myapp", 1, "", false},
+		{"a..example.com", 1, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := hostLabel(tt.hostname, tt.index)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("hostLabel(%q, %d) = %q, %v, want %q, %v", tt.hostname, tt.index, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAppLabelIndexRouting(t *testing.T) {
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h\napp_label_index 1")
+
+	for _, host := range []string{"api.myapp.example.com", "www.myapp.example.com:8443"} {
+		rec, upstream := serveTest(rs, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Code != http.StatusOK || !strings.HasPrefix(upstream, "127.0.0.1:") {
+			t.Errorf("%s: status = %d, upstream %q, want myapp's VM", host, rec.Code, upstream)
+		}
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 1 {
+		t.Errorf("resumed %d times, want 1 for one app", n)
+	}
+
+	rec, _ := serveTest(rs, httptest.NewRequest(http.MethodGet, "http://myapp/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("hostname too shallow: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestRetryAfterNotWaking(t *testing.T) {
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h\nretry_after 7s\nwake_bypass {\n header X-Scrape 1\n}")
+
+	req := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil)
+	req.Header.Set("X-Scrape", "1")
+	rec, _ := serveTest(rs, req)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "7" {
+		t.Errorf("paused bypass: status %d, Retry-After %q, want 503 and 7", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rs.maintenance.Store(true)
+	rec, _ = serveTest(rs, httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "7" {
+		t.Errorf("maintenance: status %d, Retry-After %q, want 503 and 7", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 0 {
+		t.Errorf("resumed %d times", n)
+	}
+}
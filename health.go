@@ -0,0 +1,109 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"net"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(HealthEvents{})
+}
+
+// HealthEvents feeds reverse_proxy health check results back into
+// relight_slicervm. Subscribed to the "unhealthy" event, it marks every app
+// served from the failing upstream's IP stale, so the next request asks
+// Slicer for the VM's real status (and resumes it if it was paused behind
+// the module's back) instead of proxying to a dead upstream. Subscribed to
+// "healthy" as well, it ends the fallback_upstream routing for that IP.
+//
+//	{
+//	    events {
+//	        on unhealthy relight_slicervm [rewake]
+//	        on healthy relight_slicervm
+//	    }
+//	}
+type HealthEvents struct {
+	// Rewake also wakes the affected apps straight away rather than on
+	// their next request.
+	Rewake bool `json:"rewake,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (HealthEvents) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "events.handlers.relight_slicervm",
+		New: func() caddy.Module { return new(HealthEvents) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (he *HealthEvents) Provision(ctx caddy.Context) error {
+	he.logger = ctx.Logger()
+	return nil
+}
+
+// Handle implements caddyevents.Handler.
+func (he *HealthEvents) Handle(ctx context.Context, e caddy.Event) error {
+	if e.Name() != "unhealthy" && e.Name() != "healthy" {
+		return nil
+	}
+	addr, _ := e.Data["host"].(string)
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	if ip == "" {
+		return nil
+	}
+
+	if e.Name() == "healthy" {
+		for _, rs := range snapshotInstances() {
+			rs.stateMgr.markHealthy(ip)
+		}
+		return nil
+	}
+
+	for _, rs := range snapshotInstances() {
+		for _, app := range rs.stateMgr.invalidateIP(ip) {
+			he.logger.Info("upstream unhealthy, refreshing app state",
+				zap.String("app", app),
+				zap.String("upstream", addr),
+			)
+			if he.Rewake {
+				go rs.wakeInBackground(app)
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	relight_slicervm [rewake]
+func (he *HealthEvents) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume handler name
+	if d.NextArg() {
+		if d.Val() != "rewake" {
+			return d.Errf("unknown option: %s", d.Val())
+		}
+		he.Rewake = true
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*HealthEvents)(nil)
+	_ caddyevents.Handler   = (*HealthEvents)(nil)
+	_ caddyfile.Unmarshaler = (*HealthEvents)(nil)
+)
@@ -0,0 +1,245 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// fakeSlicer is a minimal Slicer API for tests. It serves nodes, records
+// every call as "METHOD /path" and moves nodes between states as they are
+// resumed, paused, suspended and restored.
+type fakeSlicer struct {
+	mu    sync.Mutex
+	nodes []map[string]any
+	calls []string
+
+	// onResume and onPause, when set, are called for each resume and pause
+	// before the node changes state, outside mu so they may block. A
+	// non-zero status fails the call with that status and body.
+	onResume func(hostname string) (status int, body string)
+	onPause  func(hostname string) (status int, body string)
+
+	// onHostGroup, when set, is called for each host group node listing
+	// and fails it the same way.
+	onHostGroup func(group string) (status int, body string)
+
+	url string
+}
+
+// newFakeSlicer starts a fakeSlicer with a single paused node apps-1 at
+// 127.0.0.1, tagged myapp.
+func newFakeSlicer(t *testing.T) *fakeSlicer {
+	t.Helper()
+	f := &fakeSlicer{}
+	f.addNode("apps-1", "127.0.0.1", "Paused", "myapp")
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	return f
+}
+
+// addNode adds a node to the fake's host group.
+func (f *fakeSlicer) addNode(hostname, ip, status string, tags ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes = append(f.nodes, map[string]any{"hostname": hostname, "ip": ip, "status": status, "tags": tags})
+}
+
+// setNodes replaces the fake's nodes.
+func (f *fakeSlicer) setNodes(nodes ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes = nodes
+}
+
+// snapshotCalls returns the calls made so far.
+func (f *fakeSlicer) snapshotCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+// count returns how many calls were made to method and path.
+func (f *fakeSlicer) count(method, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == method+" "+path {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeSlicer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/nodes":
+		f.writeNodes(w, "")
+	case len(parts) == 3 && parts[0] == "hostgroup" && parts[2] == "nodes":
+		if f.onHostGroup != nil {
+			if code, body := f.onHostGroup(parts[1]); code != 0 {
+				http.Error(w, body, code)
+				return
+			}
+		}
+		f.writeNodes(w, parts[1])
+	case len(parts) == 3 && parts[0] == "vm" && r.Method == http.MethodPost:
+		hostname := parts[1]
+		var hook func(string) (int, string)
+		status := ""
+		switch parts[2] {
+		case "resume":
+			hook, status = f.onResume, "Running"
+		case "pause":
+			hook, status = f.onPause, "Paused"
+		case "suspend":
+			status = "Stopped"
+		case "restore":
+			status = "Running"
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if !f.setStatus(hostname, "") {
+			http.Error(w, "no such VM", http.StatusNotFound)
+			return
+		}
+		if hook != nil {
+			if code, body := hook(hostname); code != 0 {
+				http.Error(w, body, code)
+				return
+			}
+		}
+		f.setStatus(hostname, status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeNodes writes the nodes of group, or all nodes if group is empty. A
+// node's group is its hostname prefix; nodes without a hostname are listed
+// in every group.
+func (f *fakeSlicer) writeNodes(w http.ResponseWriter, group string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []map[string]any{}
+	for _, n := range f.nodes {
+		if h, _ := n["hostname"].(string); group == "" || h == "" || strings.HasPrefix(h, group+"-") {
+			out = append(out, n)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// setStatus sets the status of node hostname, unless status is empty, and
+// reports whether the node exists.
+func (f *fakeSlicer) setStatus(hostname, status string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, n := range f.nodes {
+		if n["hostname"] == hostname {
+			if status != "" {
+				n["status"] = status
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// newTestHandler provisions a handler for host group apps on f, with the
+// extra Caddyfile subdirectives in cfg, and cleans it up after the test. It
+// returns once the idle watcher's first health check is done, so the
+// check's Slicer call does not land in the middle of a test.
+func newTestHandler(t *testing.T, f *fakeSlicer, cfg string) *SlicerVM {
+	t.Helper()
+	rs, err := provisionTestHandler(t, f, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, time.Second, func() bool { return !rs.stateMgr.healthStatus().CheckedAt.IsZero() })
+	return rs
+}
+
+// provisionTestHandler is newTestHandler returning rather than failing on
+// config errors.
+func provisionTestHandler(t *testing.T, f *fakeSlicer, cfg string) (*SlicerVM, error) {
+	t.Helper()
+	d := caddyfile.NewTestDispenser("relight_slicervm {\n" +
+		"slicer_url " + f.url + "\n" +
+		"slicer_token test\n" +
+		"host_group apps\n" +
+		cfg + "\n}")
+	rs := new(SlicerVM)
+	if err := rs.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	ctx, err := caddy.ProvisionContext(&caddy.Config{Admin: &caddy.AdminConfig{Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Provision(ctx); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { rs.Cleanup() })
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// serveTest runs req through rs with a next handler that answers 200 and
+// returns the response and the upstream rs selected.
+func serveTest(rs *SlicerVM, req *http.Request) (*httptest.ResponseRecorder, string) {
+	rec := httptest.NewRecorder()
+	var upstream string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		upstream, _ = caddyhttp.GetVar(r.Context(), "relight_slicervm_upstream").(string)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	if err := rs.ServeHTTP(rec, withCaddyContext(req), next); err != nil {
+		rec.Code = http.StatusInternalServerError
+	}
+	return rec, upstream
+}
+
+// withCaddyContext adds the replacer and vars Caddy's server puts in every
+// request context.
+func withCaddyContext(req *http.Request) *http.Request {
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	return req.WithContext(ctx)
+}
+
+// eventually fails the test unless cond holds within timeout.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,45 @@
+package caddyrelightslicervm
+
+import "time"
+
+// stateTransition is one entry in an app's state history.
+type stateTransition struct {
+	At     time.Time `json:"at"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// record appends the transition from from to info's current status to its
+// history, keeping only the newest historySize entries. Called with m.mu
+// held.
+func (m *vmStateManager) record(info *vmInfo, from vmStatus, reason string, err error) {
+	if m.historySize <= 0 {
+		return
+	}
+	t := stateTransition{
+		At:     time.Now(),
+		From:   from.String(),
+		To:     info.status.String(),
+		Reason: reason,
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	if len(info.history) >= m.historySize {
+		info.history = append(info.history[:0], info.history[len(info.history)-m.historySize+1:]...)
+	}
+	info.history = append(info.history, t)
+}
+
+// history returns a copy of appName's recent state transitions, oldest
+// first. The bool is false if the app has not been looked up.
+func (m *vmStateManager) history(appName string) ([]stateTransition, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.vms[appName]; ok {
+		return append([]stateTransition(nil), info.history...), true
+	}
+	return nil, false
+}
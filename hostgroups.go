@@ -0,0 +1,160 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+	"go.uber.org/zap"
+)
+
+// groupsFor returns the host groups to search for appName: the group
+// mapped to the longest matching domain suffix, or every configured group.
+func (m *vmStateManager) groupsFor(appName string) []string {
+	best := ""
+	for suffix := range m.groupSuffixes {
+		if strings.HasSuffix(appName, suffix) && len(suffix) > len(best) {
+			best = suffix
+		}
+	}
+	if best != "" {
+		return []string{m.groupSuffixes[best]}
+	}
+	return m.hostGroups
+}
+
+// filterGroups restricts nodes to the members of the host groups searched
+// for appName and returns the group of each remaining node by hostname.
+// GET /nodes spans every group but does not say which one a node is in,
+// so membership comes from GET /hostgroup/{name}/nodes. With a single host
+// group and no suffix mapping nodes are returned unfiltered, as before
+// multiple groups were supported.
+func (m *vmStateManager) filterGroups(ctx context.Context, appName string, nodes []sdk.SlicerNode) ([]sdk.SlicerNode, map[string]string, error) {
+	if len(m.hostGroups) <= 1 && len(m.groupSuffixes) == 0 {
+		return nodes, nil, nil
+	}
+
+	members := make(map[string]string)
+	for _, group := range m.groupsFor(appName) {
+		groupNodes, err := m.client.GetHostGroupNodes(ctx, group)
+		if err != nil {
+			return nil, nil, fmt.Errorf("listing nodes of host group %q: %w", group, err)
+		}
+		for _, n := range groupNodes {
+			if _, ok := members[n.Hostname]; !ok {
+				members[n.Hostname] = group
+			}
+		}
+	}
+
+	var filtered []sdk.SlicerNode
+	for _, n := range nodes {
+		if _, ok := members[n.Hostname]; ok {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered, members, nil
+}
+
+// firstGroup narrows matched to the nodes of the first host group searched
+// for appName that has any, so an app tagged in several groups is served
+// from one of them, in configuration order. groups maps hostnames to their
+// group, as returned by filterGroups; with no groups matched is returned
+// as is.
+func (m *vmStateManager) firstGroup(appName string, matched []sdk.SlicerNode, groups map[string]string) ([]sdk.SlicerNode, string) {
+	if groups == nil {
+		return matched, ""
+	}
+	for _, group := range m.groupsFor(appName) {
+		var nodes []sdk.SlicerNode
+		for _, n := range matched {
+			if groups[n.Hostname] == group {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) > 0 {
+			return nodes, group
+		}
+	}
+	return nil, ""
+}
+
+// refreshResult is the outcome of refreshGroup, as served by the admin API.
+// Error is set if the nodes could not be listed at all, and Failed holds
+// the error for each app that could not be reconciled; such apps keep their
+// cache entry, marked stale so their next request fetches it again.
+type refreshResult struct {
+	HostGroup string            `json:"host_group"`
+	Refreshed int               `json:"refreshed"`
+	Removed   []string          `json:"removed"`
+	Failed    map[string]string `json:"failed,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// refreshGroup fetches the nodes of the host groups once and reconciles
+// every cached app against them: apps whose VMs still exist get their
+// current nodes and status, keeping their activity, and apps whose VMs are
+// gone are dropped. Apps are keyed by the name they are requested under,
+// so new apps are not added here; dropping cached not-found entries lets
+// their first request find them straight away. Apps that are waking are
+// left to their wake. An app that fails to reconcile is recorded in the
+// result and the rest are still refreshed.
+func (m *vmStateManager) refreshGroup(ctx context.Context) (refreshResult, error) {
+	res := refreshResult{HostGroup: m.hostGroup, Removed: []string{}}
+
+	m.mu.Lock()
+	var apps []string
+	for name, info := range m.vms {
+		switch info.status {
+		case statusNotFound:
+			delete(m.vms, name)
+		case statusWaking:
+		default:
+			apps = append(apps, name)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(apps)
+
+	nodes, err := m.client.ListVMs(ctx)
+	if err != nil {
+		return res, fmt.Errorf("listing VMs: %w", err)
+	}
+	for _, app := range apps {
+		m.mu.Lock()
+		cached, ok := m.vms[app]
+		if !ok || cached.status == statusWaking {
+			m.mu.Unlock()
+			continue
+		}
+		cached.stale = true
+		m.mu.Unlock()
+
+		info, err := m.applyNodes(ctx, app, nodes)
+		if err != nil {
+			if res.Failed == nil {
+				res.Failed = make(map[string]string)
+			}
+			res.Failed[app] = err.Error()
+			continue
+		}
+
+		m.mu.Lock()
+		if info.status == statusNotFound && m.vms[app] == info {
+			delete(m.vms, app)
+			res.Removed = append(res.Removed, app)
+		} else {
+			res.Refreshed++
+		}
+		m.mu.Unlock()
+	}
+
+	m.logger.Info("host group refreshed",
+		zap.Int("refreshed", res.Refreshed),
+		zap.Strings("removed", res.Removed),
+		zap.Int("failed", len(res.Failed)),
+	)
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package caddyrelightslicervm
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlLRU is a fixed-size set of keys that expire after a TTL. The least
+// recently used key is evicted when the set is full.
+type ttlLRU struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	order   *list.List // front is most recently used
+	items   map[string]*list.Element
+
+	// onEvict, if set, is called (with mu held) when a key is evicted to
+	// make room, not when it merely expires.
+	onEvict func()
+}
+
+type ttlLRUEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newTTLLRU(maxSize int, ttl time.Duration) *ttlLRU {
+	return &ttlLRU{
+		maxSize: maxSize,
+		ttl:     ttl,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// contains reports whether key is present and unexpired.
+func (c *ttlLRU) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(el.Value.(*ttlLRUEntry).expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return false
+	}
+	c.order.MoveToFront(el)
+	return true
+}
+
+// add inserts or refreshes key.
+func (c *ttlLRU) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		el.Value.(*ttlLRUEntry).expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	for c.order.Len() >= c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*ttlLRUEntry).key)
+		if c.onEvict != nil {
+			c.onEvict()
+		}
+	}
+	c.items[key] = c.order.PushFront(&ttlLRUEntry{key: key, expires: expires})
+}
+
+// remove deletes key if present.
+func (c *ttlLRU) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
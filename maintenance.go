@@ -0,0 +1,84 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// scopedMaintenance is the runtime maintenance state of individual apps and
+// host groups, set through the admin API while the rest of the handler
+// keeps serving. Each entry maps a name to the message served for it.
+type scopedMaintenance struct {
+	mu     sync.Mutex
+	apps   map[string]string
+	groups map[string]string
+}
+
+func newScopedMaintenance() *scopedMaintenance {
+	return &scopedMaintenance{apps: make(map[string]string), groups: make(map[string]string)}
+}
+
+// set puts apps and host groups into maintenance with message, or takes
+// them out of it.
+func (sm *scopedMaintenance) set(apps, groups []string, enabled bool, message string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	toggle := func(m map[string]string, names []string) {
+		for _, name := range names {
+			if enabled {
+				m[name] = message
+			} else {
+				delete(m, name)
+			}
+		}
+	}
+	toggle(sm.apps, apps)
+	toggle(sm.groups, groups)
+}
+
+// list returns the apps and host groups in maintenance, sorted.
+func (sm *scopedMaintenance) list() (apps, groups []string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return slices.Sorted(maps.Keys(sm.apps)), slices.Sorted(maps.Keys(sm.groups))
+}
+
+// appMaintenance reports whether appName is in maintenance, by its full
+// name, its first label or its host group, and the message to serve. The
+// host group is only looked up while some group is in maintenance.
+func (rs *SlicerVM) appMaintenance(ctx context.Context, appName string) (string, bool) {
+	sm := rs.scopedMaintenance
+	sm.mu.Lock()
+	msg, ok := sm.apps[appName]
+	if !ok {
+		msg, ok = sm.apps[firstLabel(appName)]
+	}
+	groups := len(sm.groups) > 0
+	sm.mu.Unlock()
+	if ok || !groups {
+		return msg, ok
+	}
+
+	group, err := rs.stateMgr.groupOf(ctx, appName)
+	if err != nil {
+		return "", false
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	msg, ok = sm.groups[group]
+	return msg, ok
+}
+
+// groupOf returns the host group appName's VMs are in.
+func (m *vmStateManager) groupOf(ctx context.Context, appName string) (string, error) {
+	info, err := m.lookup(ctx, appName)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Without several groups, nodes are not tagged with theirs.
+	return m.hostGroupOf(info), nil
+}
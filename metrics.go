@@ -0,0 +1,122 @@
+package caddyrelightslicervm
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var slicerMetrics = struct {
+	once           sync.Once
+	pausedDuration *prometheus.HistogramVec
+	wakesShed      *prometheus.CounterVec
+	recycles       *prometheus.CounterVec
+	runningVMs     *prometheus.GaugeVec
+	vms            *prometheus.GaugeVec
+	wakeDuration   *prometheus.HistogramVec
+	wakes          *prometheus.CounterVec
+	wakeTimeouts   *prometheus.CounterVec
+
+	askNegativeCache *prometheus.CounterVec
+	askPositiveCache *prometheus.CounterVec
+}{}
+
+// Values for the result label of the wake metrics.
+const (
+	wakeResultSuccess = "success"
+	wakeResultFailure = "failure"
+)
+
+// registerMetrics creates the module's collectors once per process and
+// registers them with the config's metrics registry. Several handler
+// instances share the same collectors, so duplicate registration is fine.
+func registerMetrics(registry *prometheus.Registry) error {
+	const ns, sub = "caddy", "relight_slicervm"
+
+	slicerMetrics.once.Do(func() {
+		slicerMetrics.pausedDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "paused_duration_seconds",
+			Help:      "How long VMs stayed paused before their next successful wake.",
+			Buckets:   []float64{10, 30, 60, 120, 300, 600, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+		}, []string{"host_group"})
+		slicerMetrics.wakesShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "wakes_shed_total",
+			Help:      "Wakes refused because too many VMs were already waking or running.",
+		}, []string{"host_group"})
+		slicerMetrics.recycles = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "recycles_total",
+			Help:      "VMs paused for exceeding max_running_lifetime.",
+		}, []string{"host_group"})
+		slicerMetrics.runningVMs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "running_vms",
+			Help:      "Running VMs after the latest idle watcher sweep.",
+		}, []string{"host_group"})
+		slicerMetrics.vms = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "vms",
+			Help:      "Known VMs by cached status after the latest idle watcher sweep.",
+		}, []string{"host_group", "status"})
+		slicerMetrics.wakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "wake_duration_seconds",
+			Help:      "Time from starting a wake until it succeeded or failed.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60},
+		}, []string{"host_group", "app", "result"})
+		slicerMetrics.wakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "wakes_total",
+			Help:      "Completed wakes by result (success or failure).",
+		}, []string{"host_group", "app", "result"})
+		slicerMetrics.wakeTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "wake_timeouts_total",
+			Help:      "Requests that gave up waiting for a wake after wake_timeout.",
+		}, []string{"host_group", "app"})
+		slicerMetrics.askNegativeCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "ask_negative_cache_total",
+			Help:      "Ask server negative cache hits, misses and evictions.",
+		}, []string{"event"})
+		slicerMetrics.askPositiveCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "ask_positive_cache_total",
+			Help:      "Ask server positive cache hits, misses and evictions.",
+		}, []string{"event"})
+	})
+
+	for _, c := range []prometheus.Collector{
+		slicerMetrics.pausedDuration,
+		slicerMetrics.wakesShed,
+		slicerMetrics.recycles,
+		slicerMetrics.runningVMs,
+		slicerMetrics.vms,
+		slicerMetrics.wakeDuration,
+		slicerMetrics.wakes,
+		slicerMetrics.wakeTimeouts,
+		slicerMetrics.askNegativeCache,
+		slicerMetrics.askPositiveCache,
+	} {
+		if err := registry.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package caddyrelightslicervm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsLabelledByHostGroup(t *testing.T) {
+	f := newFakeSlicer(t)
+	f.addNode("batch-1", "127.0.0.2", "Paused", "job")
+	rs := newTestHandler(t, f, "idle_timeout 1h\nhost_group batch .batch.example.com")
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(slicerMetrics.wakes)
+	wakes := func(group string) float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if labels["host_group"] == group && labels["result"] == wakeResultSuccess {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+	apps, batch := wakes("apps"), wakes("batch")
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "job.batch.example.com", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := wakes("batch") - batch; got != 1 {
+		t.Errorf("wakes in batch = %v, want 1", got)
+	}
+	if got := wakes("apps") - apps; got != 0 {
+		t.Errorf("wakes in apps = %v, want 0", got)
+	}
+	if got := rs.stateMgr.appHostGroup("unknown"); got != "apps" {
+		t.Errorf("group of an unknown app = %q, want the primary group", got)
+	}
+
+	running := rs.stateMgr.runningVMs()
+	if running["batch"] != 1 || running["apps"] != 0 || len(running) != 2 {
+		t.Errorf("running VMs = %v, want 1 in batch and 0 in apps", running)
+	}
+	statuses := rs.stateMgr.vmsByStatus()
+	if statuses["batch"][statusRunning] != 1 {
+		t.Errorf("running in batch = %d, want 1", statuses["batch"][statusRunning])
+	}
+	if _, ok := statuses["apps"][statusPaused]; !ok {
+		t.Error("apps group missing from the status gauges")
+	}
+}
@@ -0,0 +1,170 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// persistVersion is the version of the persisted state format. Snapshots
+// written with another version are ignored rather than misread.
+const persistVersion = 1
+
+// persistTimeout bounds each load or store of the persisted state.
+const persistTimeout = 10 * time.Second
+
+// persistedState is the snapshot of the state cache kept in Caddy's storage
+// so activity survives config reloads and restarts.
+type persistedState struct {
+	Version int                     `json:"version"`
+	SavedAt time.Time               `json:"saved_at"`
+	Apps    map[string]persistedApp `json:"apps"`
+}
+
+type persistedApp struct {
+	Hostname     string          `json:"hostname"`
+	HostGroup    string          `json:"host_group,omitempty"`
+	Nodes        []persistedNode `json:"nodes"`
+	LastSeen     time.Time       `json:"last_seen"`
+	WarmUntil    time.Time       `json:"warm_until,omitzero"`
+	PausedAt     time.Time       `json:"paused_at,omitzero"`
+	RunningSince time.Time       `json:"running_since,omitzero"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+}
+
+type persistedNode struct {
+	Hostname string   `json:"hostname"`
+	IP       string   `json:"ip"`
+	Status   vmStatus `json:"status"`
+
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, the inverse of
+// MarshalText. Unrecognised names decode as unknown.
+func (s *vmStatus) UnmarshalText(text []byte) error {
+	*s = statusUnknown
+	for _, status := range []vmStatus{statusRunning, statusPaused, statusWaking, statusNotFound, statusStarting, statusStopped, statusError} {
+		if string(text) == status.String() {
+			*s = status
+		}
+	}
+	return nil
+}
+
+// exportState snapshots the apps whose VMs are known. Not-found entries are
+// left out; they are cheap to look up again.
+func (m *vmStateManager) exportState() persistedState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ps := persistedState{Version: persistVersion, SavedAt: time.Now(), Apps: make(map[string]persistedApp, len(m.vms))}
+	for name, info := range m.vms {
+		if len(info.nodes) == 0 {
+			continue
+		}
+		app := persistedApp{
+			Hostname:     info.hostname,
+			HostGroup:    info.hostGroup,
+			LastSeen:     info.lastSeen,
+			WarmUntil:    info.warmUntil,
+			PausedAt:     info.pausedAt,
+			RunningSince: info.runningSince,
+			FetchedAt:    info.fetchedAt,
+		}
+		for _, n := range info.nodes {
+			app.Nodes = append(app.Nodes, persistedNode{Hostname: n.hostname, IP: n.ip, Status: n.status, Suspended: n.suspended})
+		}
+		ps.Apps[name] = app
+	}
+	return ps
+}
+
+// importState seeds the cache from a snapshot, skipping apps already known
+// and apps fetched longer than maxAge ago, and returns how many it restored.
+// Restored entries are stale, so their next lookup asks Slicer for the
+// current status, but they keep their activity so the idle watcher pauses
+// them on schedule.
+func (m *vmStateManager) importState(ps persistedState, maxAge time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	restored := 0
+	for name, app := range ps.Apps {
+		if _, ok := m.vms[name]; ok || len(app.Nodes) == 0 || time.Since(app.FetchedAt) > maxAge {
+			continue
+		}
+		info := &vmInfo{
+			hostname:     app.Hostname,
+			hostGroup:    app.HostGroup,
+			lastSeen:     app.LastSeen,
+			warmUntil:    app.WarmUntil,
+			pausedAt:     app.PausedAt,
+			runningSince: app.RunningSince,
+			fetchedAt:    app.FetchedAt,
+			stale:        true,
+		}
+		for _, n := range app.Nodes {
+			status := n.Status
+			if status == statusWaking {
+				// The wake died with the previous config.
+				status = statusUnknown
+			}
+			info.nodes = append(info.nodes, &vmNode{hostname: n.Hostname, ip: n.IP, status: status, suspended: n.Suspended})
+		}
+		info.refresh()
+		if info.status != statusRunning {
+			info.runningSince = time.Time{}
+		}
+		m.vms[name] = info
+		restored++
+	}
+	return restored
+}
+
+// saveState writes the state snapshot to Caddy's storage under key.
+func (m *vmStateManager) saveState(key string) error {
+	data, err := json.Marshal(m.exportState())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	return m.caddyCtx.Storage().Store(ctx, key, data)
+}
+
+// loadState restores the snapshot stored under key, if any. A missing or
+// unreadable snapshot only costs the cached activity, so it is logged
+// rather than failing provisioning.
+func (m *vmStateManager) loadState(key string, maxAge time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+
+	data, err := m.caddyCtx.Storage().Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var ps persistedState
+	if err == nil {
+		err = json.Unmarshal(data, &ps)
+	}
+	if err == nil && ps.Version != persistVersion {
+		err = fmt.Errorf("unsupported version %d", ps.Version)
+	}
+	if err != nil {
+		m.logger.Warn("ignoring persisted state", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	restored := m.importState(ps, maxAge)
+	m.logger.Info("restored persisted state",
+		zap.String("key", key),
+		zap.Int("apps", restored),
+		zap.Time("saved_at", ps.SavedAt),
+	)
+}
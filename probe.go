@@ -0,0 +1,130 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// readinessProbe polls a resumed VM until its app is ready to serve, so the
+// first proxied request doesn't hit a port that isn't accepting yet. With
+// an empty path it only checks that the port accepts TCP connections.
+type readinessProbe struct {
+	scheme   string
+	path     string
+	port     int
+	interval time.Duration
+
+	// header, if set, must be present on the probe response, and equal to
+	// value when value is set. This distinguishes "web server is up" from
+	// "app fully initialised".
+	header string
+	value  string
+
+	client *http.Client
+}
+
+func newReadinessProbe(path string, port int, interval time.Duration, header, value string) *readinessProbe {
+	return &readinessProbe{
+		scheme:   "http",
+		path:     path,
+		port:     port,
+		interval: interval,
+		header:   header,
+		value:    value,
+		client: &http.Client{
+			// Never follow redirects; a 3xx already proves the app is up.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// addr returns the probe address for a VM at ip.
+func (p *readinessProbe) addr(ip string) string {
+	return net.JoinHostPort(ip, strconv.Itoa(p.port))
+}
+
+// wait probes addr every interval until a check passes or ctx is done.
+func (p *readinessProbe) wait(ctx context.Context, addr string) error {
+	for {
+		err := p.check(ctx, addr)
+		if err == nil {
+			return nil
+		}
+
+		timer := time.NewTimer(p.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("readiness probe for %s: %w (last error: %v)", addr, ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// check performs a single probe request against addr.
+func (p *readinessProbe) check(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, max(p.interval, time.Second))
+	defer cancel()
+
+	if p.path == "" {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.scheme+"://"+addr+p.path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if p.header != "" {
+		got := resp.Header.Get(p.header)
+		if got == "" {
+			return fmt.Errorf("response has no %s header", p.header)
+		}
+		if p.value != "" && got != p.value {
+			return fmt.Errorf("%s header is %q, want %q", p.header, got, p.value)
+		}
+	}
+	return nil
+}
+
+// newUpstreamClient returns the client for the module's own requests to
+// apps, speaking proto. With insecure, https certificates are not verified.
+func newUpstreamClient(insecure bool, proto string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	protocols := new(http.Protocols)
+	switch proto {
+	case upstreamProtoH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	case upstreamProtoH2:
+		protocols.SetHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+	transport.Protocols = protocols
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,129 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestReadinessProbeCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		respHeader    string
+		header, value string
+		wantErr       bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "redirect", status: http.StatusFound},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "not found", status: http.StatusNotFound, wantErr: true},
+		{name: "server error", status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "header present", status: http.StatusOK, respHeader: "1", header: "X-App-Ready"},
+		{name: "header missing", status: http.StatusOK, header: "X-App-Ready", wantErr: true},
+		{name: "header value matches", status: http.StatusOK, respHeader: "yes", header: "X-App-Ready", value: "yes"},
+		{name: "header value differs", status: http.StatusOK, respHeader: "no", header: "X-App-Ready", value: "yes", wantErr: true},
+		{name: "error status with header", status: http.StatusInternalServerError, respHeader: "yes", header: "X-App-Ready", value: "yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/healthz" {
+					http.NotFound(w, r)
+					return
+				}
+				if tt.respHeader != "" {
+					w.Header().Set("X-App-Ready", tt.respHeader)
+				}
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "/login")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			t.Cleanup(app.Close)
+
+			p := newReadinessProbe("/healthz", 0, 10*time.Millisecond, tt.header, tt.value)
+			err := p.check(t.Context(), strings.TrimPrefix(app.URL, "http://"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadinessProbeWait(t *testing.T) {
+	var ready atomic.Bool
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ready.Load() {
+			w.Header().Set("X-App-Ready", "1")
+		}
+	}))
+	t.Cleanup(app.Close)
+	addr := strings.TrimPrefix(app.URL, "http://")
+	p := newReadinessProbe("/", 0, 10*time.Millisecond, "X-App-Ready", "1")
+
+	time.AfterFunc(50*time.Millisecond, func() { ready.Store(true) })
+	if err := p.wait(t.Context(), addr); err != nil {
+		t.Fatalf("wait = %v, want success once the header appears", err)
+	}
+
+	ready.Store(false)
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.wait(ctx, addr); err == nil {
+		t.Fatal("wait succeeded without the expected header")
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	var tlsProbes atomic.Int32
+	app := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.URL.Path == "/healthz" {
+			tlsProbes.Add(1)
+		}
+	}))
+	t.Cleanup(app.Close)
+	port := app.URL[strings.LastIndex(app.URL, ":")+1:]
+	cfg := "idle_timeout 1h\napp_port " + port + "\nready_check_path /healthz\nready_check_interval 50ms\nwake_timeout 1s\n"
+
+	t.Run("insecure", func(t *testing.T) {
+		f := newFakeSlicer(t)
+		rs := newTestHandler(t, f, cfg+"upstream_scheme https insecure")
+
+		rec := httptest.NewRecorder()
+		var scheme string
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			scheme, _ = caddyhttp.GetVar(r.Context(), "relight_slicervm_upstream_scheme").(string)
+			return nil
+		})
+		req := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil)
+		if err := rs.ServeHTTP(rec, withCaddyContext(req), next); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		if scheme != "https" {
+			t.Errorf("upstream scheme var = %q, want https", scheme)
+		}
+		if tlsProbes.Load() == 0 {
+			t.Error("readiness probe did not use TLS")
+		}
+	})
+
+	t.Run("verified", func(t *testing.T) {
+		// The test server's certificate is self-signed, so without
+		// insecure the probe cannot pass and the wake fails.
+		f := newFakeSlicer(t)
+		rs := newTestHandler(t, f, cfg+"upstream_scheme https")
+		if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); err == nil {
+			t.Fatal("wake succeeded against an unverifiable certificate")
+		}
+	})
+}
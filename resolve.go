@@ -0,0 +1,62 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// upstreamResolver resolves VM hostnames for upstream_target hostname and
+// remembers the last good answer for each, so warm apps keep serving
+// through brief DNS outages.
+type upstreamResolver struct {
+	resolver *net.Resolver
+
+	// maxStale is how old a remembered answer may be and still be used
+	// when resolution fails. Zero disables the fallback.
+	maxStale time.Duration
+
+	mu   sync.Mutex
+	last map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ip string
+	at time.Time
+}
+
+func newUpstreamResolver(maxStale time.Duration) *upstreamResolver {
+	return &upstreamResolver{
+		resolver: net.DefaultResolver,
+		maxStale: maxStale,
+		last:     make(map[string]resolvedHost),
+	}
+}
+
+// resolve returns an IP for host. If the lookup fails and a previous answer
+// is at most maxStale old, that answer is returned with stale set and the
+// lookup error, so the caller can log it.
+func (ur *upstreamResolver) resolve(ctx context.Context, host string) (ip string, stale bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	addrs, err := ur.resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %q", host)
+	}
+
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+
+	if err == nil {
+		ur.last[host] = resolvedHost{ip: addrs[0], at: time.Now()}
+		return addrs[0], false, nil
+	}
+
+	if prev, ok := ur.last[host]; ok && ur.maxStale > 0 && time.Since(prev.at) <= ur.maxStale {
+		return prev.ip, true, err
+	}
+	return "", false, fmt.Errorf("resolving %q: %w", host, err)
+}
@@ -0,0 +1,132 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	schedulerMu      sync.Mutex
+	schedulerCancels = make(map[*SlicerVM]context.CancelFunc)
+)
+
+// startWakeScheduler launches a background goroutine that resumes apps
+// according to their schedule_wake entries. It is a no-op when none are
+// configured.
+func startWakeScheduler(rs *SlicerVM) {
+	if len(rs.ScheduledWakes) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	schedulerMu.Lock()
+	schedulerCancels[rs] = cancel
+	schedulerMu.Unlock()
+
+	go runWakeScheduler(ctx, rs)
+}
+
+// stopWakeScheduler cancels the scheduler goroutine for this module instance.
+func stopWakeScheduler(rs *SlicerVM) {
+	schedulerMu.Lock()
+	cancel, ok := schedulerCancels[rs]
+	if ok {
+		delete(schedulerCancels, rs)
+	}
+	schedulerMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+func runWakeScheduler(ctx context.Context, rs *SlicerVM) {
+	defer func() {
+		if r := recover(); r != nil {
+			rs.logger.Error("wake scheduler panic recovered", zap.Any("panic", r))
+		}
+	}()
+
+	rs.logger.Info("wake scheduler started", zap.Int("schedules", len(rs.ScheduledWakes)))
+
+	for {
+		now := time.Now()
+		var due []*ScheduledWake
+		var at time.Time
+		for _, sw := range rs.ScheduledWakes {
+			next := sw.schedule.next(now)
+			if next.IsZero() {
+				continue
+			}
+			switch {
+			case at.IsZero() || next.Before(at):
+				at = next
+				due = []*ScheduledWake{sw}
+			case next.Equal(at):
+				due = append(due, sw)
+			}
+		}
+		if at.IsZero() {
+			rs.logger.Warn("wake scheduler has no upcoming schedules")
+			return
+		}
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			rs.logger.Info("wake scheduler stopped")
+			return
+		case <-timer.C:
+		}
+
+		for _, sw := range due {
+			go scheduledWake(ctx, rs, sw)
+		}
+	}
+}
+
+// prewarmApps resumes the prewarm apps in the background, without
+// blocking provisioning. Wakes go through the state manager, so they are
+// coalesced with request-driven wakes and respect max_concurrent_wakes.
+func prewarmApps(rs *SlicerVM) {
+	for _, app := range rs.Prewarm {
+		go startupPrewarm(rs, app)
+	}
+}
+
+func startupPrewarm(rs *SlicerVM, app string) {
+	timeout := time.Duration(rs.WakeTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := rs.stateMgr.ensureRunning(ctx, app, timeout); err != nil {
+		rs.logger.Error("prewarm failed", zap.String("app", app), zap.Error(err))
+		return
+	}
+	rs.stateMgr.touchLastSeen(app)
+	rs.logger.Info("prewarmed", zap.String("app", app), zap.Duration("took", time.Since(start)))
+}
+
+func scheduledWake(ctx context.Context, rs *SlicerVM, sw *ScheduledWake) {
+	timeout := time.Duration(rs.WakeTimeout)
+	wakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rs.logger.Info("scheduled wake", zap.String("app", sw.App))
+
+	if _, err := rs.stateMgr.ensureRunning(wakeCtx, sw.App, timeout); err != nil {
+		rs.logger.Error("scheduled wake failed", zap.String("app", sw.App), zap.Error(err))
+		return
+	}
+
+	rs.stateMgr.touchLastSeen(sw.App)
+	if sw.KeepWarm > 0 {
+		rs.stateMgr.keepWarmUntil(sw.App, time.Now().Add(time.Duration(sw.KeepWarm)))
+	}
+}
@@ -0,0 +1,68 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// healthCheckTimeout bounds each Slicer reachability check unless
+// slicer_timeout is set.
+const healthCheckTimeout = 10 * time.Second
+
+// slicerHealth is the latest result of checking that Slicer answers for the
+// handler's host groups.
+type slicerHealth struct {
+	HostGroup string    `json:"host_group"`
+	Reachable bool      `json:"reachable"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// checkHealth lists the nodes of every host group and records whether
+// Slicer answered. It runs when the idle watcher starts and on every sweep,
+// so the admin health endpoint serves a cached result.
+func (m *vmStateManager) checkHealth(ctx context.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx, m.healthTimeout)
+	defer cancel()
+
+	var err error
+	for _, group := range m.hostGroups {
+		if _, err = m.client.GetHostGroupNodes(checkCtx, group); err != nil {
+			err = fmt.Errorf("listing nodes of host group %q: %w", group, err)
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		// Stopped by Cleanup, not a Slicer failure.
+		return
+	}
+
+	m.mu.Lock()
+	was := m.health
+	m.health = slicerHealth{HostGroup: m.hostGroup, Reachable: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		m.health.Error = err.Error()
+	}
+	m.mu.Unlock()
+
+	switch {
+	case err != nil && (was.Reachable || was.CheckedAt.IsZero()):
+		m.logger.Warn("slicer is unreachable", zap.Error(err))
+	case err == nil && !was.Reachable && !was.CheckedAt.IsZero():
+		m.logger.Info("slicer is reachable again")
+	}
+}
+
+// healthStatus returns the latest reachability check. Before the first
+// check completes it reports Slicer as unreachable.
+func (m *vmStateManager) healthStatus() slicerHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.health.CheckedAt.IsZero() {
+		return slicerHealth{HostGroup: m.hostGroup, Error: "not checked yet"}
+	}
+	return m.health
+}
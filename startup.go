@@ -0,0 +1,55 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	sdk "github.com/slicervm/sdk"
+)
+
+// permissionProbeVM is a hostname no real VM uses. Pausing or resuming it
+// fails with "not found" for a token that may perform the operation, and
+// with 401/403 for one that may not, without touching any VM.
+const permissionProbeVM = "relight-permission-check"
+
+// checkSlicerAccess verifies at startup that Slicer is reachable, the host
+// groups exist and, unless skipPermissions is set, the token is allowed to
+// pause and resume VMs, so an under-scoped token fails Provision instead
+// of the first cold start. With suspend it also checks suspend and restore.
+// ctx bounds the whole check.
+func checkSlicerAccess(ctx context.Context, client *sdk.SlicerClient, hostGroups []string, skipPermissions, suspend bool) error {
+	for _, hostGroup := range hostGroups {
+		if _, err := client.GetHostGroupNodes(ctx, hostGroup); err != nil {
+			return fmt.Errorf("listing nodes of host group %q: %w", hostGroup, err)
+		}
+	}
+	if skipPermissions {
+		return nil
+	}
+
+	type op struct {
+		name string
+		call func(context.Context, string) error
+	}
+	ops := []op{{"pause", client.PauseVM}, {"resume", client.ResumeVM}}
+	if suspend {
+		ops = append(ops, op{"suspend", client.SuspendVM}, op{"restore", client.RestoreVM})
+	}
+	for _, op := range ops {
+		if err := op.call(ctx, permissionProbeVM); isForbidden(err) {
+			return fmt.Errorf("slicer_token is not allowed to %s VMs: %w", op.name, err)
+		}
+	}
+	return nil
+}
+
+// isForbidden reports whether err is an authentication or authorization
+// failure from the Slicer API.
+func isForbidden(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "status 401") || strings.HasPrefix(msg, "status 403")
+}
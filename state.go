@@ -2,13 +2,24 @@ package caddyrelightslicervm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	sdk "github.com/slicervm/sdk"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 // vmStatus represents the known state of a VM.
@@ -20,19 +31,151 @@ const (
 	statusPaused
 	statusWaking
 	statusNotFound
+	statusStarting // being provisioned or booted by Slicer
+	statusStopped  // stopping or stopped; ResumeVM cannot start it
+	statusError    // Slicer reports the VM as failed
 )
 
-// vmInfo holds cached state for a single VM (identified by app tag).
+// parseNodeStatus maps a node status reported by Slicer to a vmStatus.
+func parseNodeStatus(status string) vmStatus {
+	switch status {
+	case "Running":
+		return statusRunning
+	case "Paused", "Suspended":
+		return statusPaused
+	case "Provisioning", "Starting":
+		return statusStarting
+	case "Stopping", "Stopped":
+		return statusStopped
+	case "Error", "Failed":
+		return statusError
+	}
+	return statusUnknown
+}
+
+func (s vmStatus) String() string {
+	switch s {
+	case statusRunning:
+		return "running"
+	case statusPaused:
+		return "paused"
+	case statusWaking:
+		return "waking"
+	case statusNotFound:
+		return "not_found"
+	case statusStarting:
+		return "starting"
+	case statusStopped:
+		return "stopped"
+	case statusError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so statuses serialise as
+// their names.
+func (s vmStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// vmNode is one VM tagged for an app. Apps served by several VMs have one
+// node per VM.
+type vmNode struct {
+	hostname string
+	ip       string
+	status   vmStatus
+	raw      string // status as reported by Slicer
+
+	// suspended marks a paused node that was snapshotted to disk, so it is
+	// woken with RestoreVM rather than ResumeVM.
+	suspended bool
+}
+
+// vmInfo holds cached state for an app (identified by app tag). hostname and
+// ip are those of the node requests are proxied to; an app is running as
+// soon as any of its nodes is.
 type vmInfo struct {
 	hostname string
 	ip       string
 	status   vmStatus
-	lastSeen time.Time // last time a request was proxied to this VM
+	nodes    []*vmNode
+	lastSeen time.Time // last time a request to this VM started or the last one finished
+
+	// requests is the number of requests currently being proxied.
+	requests int
+
+	// served and coldStarts count the requests proxied and the wakes that
+	// brought the app up since it was first seen. lastWakeError is the
+	// most recent failed wake, kept after later wakes succeed.
+	served          uint64
+	coldStarts      uint64
+	lastWakeError   string
+	lastWakeErrorAt time.Time
+
+	// wakeTime is the total duration of the coldStarts wakes.
+	wakeTime time.Duration
+
+	// nextNode rotates requests across running nodes with roundRobin.
+	nextNode int
+
+	// idleSweeps counts consecutive idle watcher sweeps that found this VM
+	// idle. It is reset whenever activity is recorded.
+	idleSweeps int
+
+	// warmUntil holds the VM running regardless of activity until this
+	// time (e.g. after a scheduled wake).
+	warmUntil time.Time
 
 	// wakeCh is closed when a wake operation completes (success or failure).
 	// Multiple goroutines block on the same channel for coalesced wake.
 	wakeCh  chan struct{}
 	wakeErr error
+
+	// wakeFailures counts consecutive failed wakes; while cooldownUntil is
+	// in the future no new wake is attempted. healthySince is when the VM
+	// last came up successfully and is used to reset the failure count.
+	wakeFailures  int
+	cooldownUntil time.Time
+	healthySince  time.Time
+
+	// pausedAt is when the VM was last paused by this module, used to
+	// measure how long it stayed paused before the next wake.
+	pausedAt time.Time
+
+	// runningSince is when the app last started running continuously, or
+	// when it was first seen running. Zero while it is not running.
+	runningSince time.Time
+
+	// fetchedAt is when the entry was last fetched from Slicer.
+	fetchedAt time.Time
+
+	// hostGroup is the host group the app's VMs were found in, when several
+	// are configured.
+	hostGroup string
+
+	// wakeStarted is when the current or latest wake began.
+	wakeStarted time.Time
+
+	// history holds the app's most recent state transitions.
+	history []stateTransition
+
+	// stale makes the next lookup fetch the app's nodes from Slicer again.
+	stale bool
+}
+
+// resolved reports whether the entry names the VMs a wake would resume.
+// Called with m.mu held.
+func (info *vmInfo) resolved() bool {
+	if info.hostname == "" {
+		return false
+	}
+	for _, n := range info.nodes {
+		if n.hostname == "" {
+			return false
+		}
+	}
+	return true
 }
 
 // vmStateManager manages VM state and provides coalesced wake operations.
@@ -42,232 +185,1693 @@ type vmStateManager struct {
 	client    *sdk.SlicerClient
 	hostGroup string
 	logger    *zap.Logger
+
+	// events and caddyCtx emit lifecycle events; events is nil when the
+	// state manager is used without a Caddy context.
+	events   *caddyevents.App
+	caddyCtx caddy.Context
+
+	// ctx is cancelled by drain to abandon the wakes still running, which
+	// wakes tracks. draining, guarded by mu, is set once drain starts so no
+	// wake is added to wakes while it is being waited on.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wakes    sync.WaitGroup
+	draining bool
+
+	// hostGroups are the host groups searched for apps; groupSuffixes maps
+	// domain suffixes to the one group searched for matching app names.
+	// hostGroup is their metrics label.
+	hostGroups    []string
+	groupSuffixes map[string]string
+
+	// healthTimeout bounds each Slicer health check.
+	healthTimeout time.Duration
+
+	// wakeCooldown is the backoff after the first failed wake, doubling with
+	// each consecutive failure up to wakeCooldownMax. Zero disables it.
+	wakeCooldown    time.Duration
+	wakeCooldownMax time.Duration
+
+	// wakeFailureThreshold is the number of consecutive failed wakes that
+	// starts the cooldown.
+	wakeFailureThreshold int
+
+	// shedMaxWaking and shedMaxRunning refuse new wakes while that many VMs
+	// are already waking or running, so cold requests are shed under global
+	// pressure while warm apps keep serving. Zero disables each check.
+	shedMaxWaking  int
+	shedMaxRunning int
+
+	// probe, if set, must pass after ResumeVM before the VM is considered
+	// running. It may target a different port than appPort; when it does
+	// not, it follows the app's port override.
+	probe   *readinessProbe
+	appPort int
+
+	// appPorts overrides appPort per app, keyed by app name or first label.
+	appPorts map[string]int
+
+	// fetches coalesces concurrent lookups of the same app.
+	fetches singleflight.Group
+
+	// health is the latest Slicer reachability check.
+	health slicerHealth
+
+	// maintenance is the handler's maintenance flag; no VM is woken while
+	// it is set.
+	maintenance *atomic.Bool
+
+	// pausing holds a channel per node hostname being paused, closed when
+	// the pause finishes; see beginPause.
+	pausing map[string]chan struct{}
+
+	// unhealthyIPs are node addresses reported down by reverse_proxy health
+	// checks, until reported healthy again or a readiness probe passes.
+	unhealthyIPs map[string]bool
+
+	// exactTags disables the first label pass in lookup.
+	exactTags bool
+
+	// minRunningTime keeps idleApps from reporting an app until it has
+	// been running for this long.
+	minRunningTime time.Duration
+
+	// wakeConcurrency caps how many nodes of one app are resumed at once.
+	wakeConcurrency int
+
+	// wakeSlots, if set, caps how many wakes run at once across all apps.
+	// Wakes beyond it wait for a slot while their requests wait for the
+	// wake, up to the wake timeout.
+	wakeSlots chan struct{}
+
+	// upstreamScheme and upstreamClient are used for the module's own
+	// requests to apps, such as warmups.
+	upstreamScheme string
+	upstreamClient *http.Client
+
+	// roundRobin spreads requests across an app's running nodes instead of
+	// keeping them on the primary node. minReplicas, if set, caps how many
+	// paused nodes a wake resumes.
+	roundRobin  bool
+	minReplicas int
+
+	// metricsPerApp labels wake metrics with the app name.
+	metricsPerApp bool
+
+	// stateTTL is how long a cached entry is trusted before lookup fetches
+	// it again. Zero caches entries until marked stale.
+	stateTTL time.Duration
+
+	// wakeRetries is how often a transiently failing ResumeVM is retried,
+	// after a random backoff of up to wakeRetryBackoff doubled per attempt.
+	wakeRetries      int
+	wakeRetryBackoff time.Duration
+
+	// wakeTimeout bounds each node's resume and readiness probe, and the
+	// warmup after it. resumeTimeout bounds the resume call alone.
+	wakeTimeout   time.Duration
+	resumeTimeout time.Duration
+
+	// warmups maps app names to paths requested after a wake, before
+	// waiters are released.
+	warmups map[string][]string
+
+	// probeFirst runs one readiness check before ResumeVM and skips the
+	// resume if the app is already serving.
+	probeFirst bool
+
+	// historySize bounds each app's state history. Zero disables it.
+	historySize int
+}
+
+// cooldownError is returned when a wake is refused because the app failed
+// to wake recently and is backing off.
+type cooldownError struct {
+	app       string
+	remaining time.Duration
+}
+
+func (e *cooldownError) Error() string {
+	return fmt.Sprintf("app %q: cooling down after failed wake, retry in %s", e.app, e.remaining.Round(time.Second))
+}
+
+// shedError is returned when a new wake is refused because too many VMs
+// are already waking or running.
+type shedError struct {
+	app    string
+	reason string
+}
+
+func (e *shedError) Error() string {
+	return fmt.Sprintf("app %q: wake shed, %s", e.app, e.reason)
+}
+
+// unavailableError is returned for apps whose VMs are in a state that
+// ResumeVM cannot recover from, such as stopped or failed.
+type unavailableError struct {
+	app    string
+	status vmStatus
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("app %q: VM is %s", e.app, e.status)
 }
 
 func newVMStateManager(client *sdk.SlicerClient, hostGroup string, logger *zap.Logger) *vmStateManager {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &vmStateManager{
 		vms:       make(map[string]*vmInfo),
 		client:    client,
 		hostGroup: hostGroup,
 		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+
+		healthTimeout: healthCheckTimeout,
+		unhealthyIPs:  make(map[string]bool),
+		pausing:       make(map[string]chan struct{}),
 	}
 }
 
 // lookup returns cached VM info, or fetches from the API on first access.
 // It matches VM tags against the request hostname in two passes:
 //  1. Exact match - tag equals the full hostname (for custom domains like "myapp.com")
-//  2. First label match - tag equals the first subdomain label (for "myapp.apps.example.com" -> tag "myapp")
+//  2. First label match - tag equals the first subdomain label (for "myapp.apps.example.com" -> tag "myapp"),
+//     skipped with exactTags
+//
+// Entries marked stale are fetched again and updated in place, keeping
+// their activity and history. Concurrent fetches for the same hostname, such
+// as an on-demand TLS ask racing the first request, share one Slicer call.
 func (m *vmStateManager) lookup(ctx context.Context, hostname string) (*vmInfo, error) {
 	m.mu.Lock()
 	info, ok := m.vms[hostname]
-	if ok {
+	if ok && !m.needsFetch(info) {
 		m.mu.Unlock()
 		return info, nil
 	}
 	m.mu.Unlock()
 
+	// The shared fetch outlives any one caller's context; it is bounded by
+	// the Slicer client's timeout.
+	ch := m.fetches.DoChan(hostname, func() (any, error) {
+		return m.fetch(context.WithoutCancel(ctx), hostname)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*vmInfo), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetch asks Slicer for hostname's VMs and updates its cache entry.
+func (m *vmStateManager) fetch(ctx context.Context, hostname string) (*vmInfo, error) {
 	// Fetch all nodes (GET /nodes returns status, hostgroup endpoint does not)
 	nodes, err := m.client.ListVMs(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("listing VMs: %w", err)
 	}
+	return m.applyNodes(ctx, hostname, nodes)
+}
 
-	// Extract first subdomain label for fallback matching
-	firstLabel := ""
-	if idx := strings.Index(hostname, "."); idx > 0 {
-		firstLabel = hostname[:idx]
+// applyNodes updates hostname's cache entry from nodes, the full list from
+// GET /nodes.
+func (m *vmStateManager) applyNodes(ctx context.Context, hostname string, nodes []sdk.SlicerNode) (*vmInfo, error) {
+	nodes, groups, err := m.filterGroups(ctx, hostname, nodes)
+	if err != nil {
+		return nil, err
 	}
 
+	// Extract first subdomain label for fallback matching
+	label := firstLabel(hostname)
+
 	// Pass 1: exact hostname match (custom domains)
-	var matched *sdk.SlicerNode
-	for i := range nodes {
-		for _, tag := range nodes[i].Tags {
-			if tag == hostname {
-				matched = &nodes[i]
-				break
-			}
-		}
-		if matched != nil {
-			break
-		}
-	}
+	matched := matchNodes(nodes, hostname)
 
 	// Pass 2: first subdomain label match (wildcard subdomains)
-	if matched == nil && firstLabel != "" {
-		for i := range nodes {
-			for _, tag := range nodes[i].Tags {
-				if tag == firstLabel {
-					matched = &nodes[i]
-					break
-				}
-			}
-			if matched != nil {
-				break
-			}
-		}
+	if len(matched) == 0 && label != "" && !m.exactTags {
+		matched = matchNodes(nodes, label)
 	}
 
+	matched, group := m.firstGroup(hostname, matched, groups)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Check again under lock
-	if info, ok := m.vms[hostname]; ok {
+	info, ok := m.vms[hostname]
+	if ok && !m.needsFetch(info) {
 		return info, nil
 	}
 
-	if matched == nil {
-		info := &vmInfo{status: statusNotFound}
+	if len(matched) == 0 {
+		if ok && info.status != statusNotFound {
+			m.logger.Info("VM no longer found", zap.String("app", hostname))
+		}
+		info := &vmInfo{status: statusNotFound, fetchedAt: time.Now()}
 		m.vms[hostname] = info
 		return info, nil
 	}
 
-	info = &vmInfo{
-		hostname: matched.Hostname,
-		ip:       matched.IP,
-		lastSeen: time.Now(),
+	suspended := make(map[string]bool)
+	if ok {
+		for _, n := range info.nodes {
+			suspended[n.hostname] = n.suspended
+		}
 	}
-	switch matched.Status {
-	case "Running":
-		info.status = statusRunning
-	case "Paused":
-		info.status = statusPaused
-	default:
+	var vmNodes []*vmNode
+	for _, node := range matched {
+		n := &vmNode{hostname: node.Hostname, ip: node.IP, status: parseNodeStatus(node.Status), raw: node.Status}
+		if node.Status == "Suspended" || suspended[node.Hostname] && n.status != statusRunning {
+			// A node this module suspended stays suspended until it is
+			// seen running, whatever Slicer calls the state.
+			n.status = statusPaused
+			n.suspended = true
+		}
+		vmNodes = append(vmNodes, n)
+	}
+
+	if ok && info.status != statusNotFound {
+		from, stale := info.status, info.stale
+		info.stale = false
+		info.fetchedAt = time.Now()
+		info.hostGroup = group
+		info.nodes = vmNodes
 		info.status = statusUnknown
+		info.refresh()
+		switch {
+		case info.status != statusRunning:
+			info.runningSince = time.Time{}
+		case from != statusRunning:
+			info.runningSince = time.Now()
+		}
+		if stale || info.status != from {
+			m.record(info, from, "refreshed", nil)
+		}
+		return info, nil
 	}
+
+	info = &vmInfo{lastSeen: time.Now(), fetchedAt: time.Now(), nodes: vmNodes, hostGroup: group}
+	info.refresh()
+	if info.status == statusRunning {
+		info.runningSince = info.lastSeen
+	}
+	m.record(info, statusUnknown, "discovered", nil)
 	m.vms[hostname] = info
 	return info, nil
 }
 
-// ensureRunning makes sure the VM for appName is running. If paused, it
-// initiates a resume and blocks until done.
-// Concurrent callers are coalesced - only one ResumeVM call is made.
-func (m *vmStateManager) ensureRunning(ctx context.Context, appName string, timeout time.Duration) (string, error) {
-	info, err := m.lookup(ctx, appName)
-	if err != nil {
-		return "", err
+// needsFetch reports whether a cached entry must be fetched from Slicer
+// again: it is stale, or older than stateTTL. Entries mid-wake are kept
+// until the wake completes. Called with m.mu held.
+func (m *vmStateManager) needsFetch(info *vmInfo) bool {
+	if info.stale {
+		return true
 	}
+	return m.stateTTL > 0 && info.status != statusWaking && time.Since(info.fetchedAt) >= m.stateTTL
+}
 
-	switch info.status {
-	case statusNotFound:
-		return "", fmt.Errorf("app %q: not found", appName)
-	case statusRunning:
-		return info.ip, nil
-	case statusWaking:
-		return m.waitForWake(ctx, appName, info, timeout)
-	case statusPaused, statusUnknown:
-		return m.initiateWake(ctx, appName, info, timeout)
+// matchNodes returns every node with a tag equal to tag.
+func matchNodes(nodes []sdk.SlicerNode, tag string) []sdk.SlicerNode {
+	var matched []sdk.SlicerNode
+	for _, node := range nodes {
+		for _, t := range node.Tags {
+			if t == tag {
+				matched = append(matched, node)
+				break
+			}
+		}
 	}
-
-	return "", fmt.Errorf("app %q: unexpected status", appName)
+	return matched
 }
 
-func (m *vmStateManager) initiateWake(ctx context.Context, appName string, info *vmInfo, timeout time.Duration) (string, error) {
-	m.mu.Lock()
-	if info.status == statusWaking {
-		m.mu.Unlock()
-		return m.waitForWake(ctx, appName, info, timeout)
-	}
-	if info.status == statusRunning {
-		m.mu.Unlock()
-		return info.ip, nil
+// refresh derives the app status and the node to proxy to from the node
+// statuses: the app is running if any node is running, and requests keep
+// going to the current node for as long as it stays up. Otherwise the most
+// recoverable node status wins, so one paused node makes the app wakeable.
+// Called with m.mu held, or before info is shared.
+func (info *vmInfo) refresh() {
+	var primary *vmNode
+	has := make(map[vmStatus]bool)
+	for _, n := range info.nodes {
+		if n.status == statusRunning && (primary == nil || n.hostname == info.hostname) {
+			primary = n
+		}
+		has[n.status] = true
 	}
 
-	info.status = statusWaking
-	info.wakeCh = make(chan struct{})
-	info.wakeErr = nil
-	hostname := info.hostname
-	m.mu.Unlock()
-
-	m.logger.Info("waking VM", zap.String("app", appName), zap.String("hostname", hostname))
-	go m.doWake(appName, hostname)
-
-	return m.waitForWake(ctx, appName, info, timeout)
+	switch {
+	case primary != nil:
+		info.status = statusRunning
+	case info.status == statusWaking:
+		return
+	case has[statusPaused]:
+		info.status = statusPaused
+	case has[statusStarting]:
+		info.status = statusStarting
+	case has[statusUnknown]:
+		info.status = statusUnknown
+	case has[statusStopped]:
+		info.status = statusStopped
+	default:
+		info.status = statusError
+	}
+	if primary == nil {
+		// Keep the current node if it is still one of the app's nodes.
+		primary = info.nodes[0]
+		for _, n := range info.nodes {
+			if n.hostname == info.hostname {
+				primary = n
+			}
+		}
+	}
+	info.hostname = primary.hostname
+	info.ip = primary.ip
 }
 
-func (m *vmStateManager) waitForWake(ctx context.Context, appName string, info *vmInfo, timeout time.Duration) (string, error) {
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+// invalidateIP records ip as unhealthy and marks every app with a node at
+// ip stale, so its next lookup asks Slicer for its current status, and
+// returns those apps. Apps that are waking are left alone; their wake
+// settles their status.
+func (m *vmStateManager) invalidateIP(ip string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	select {
-	case <-info.wakeCh:
-		if info.wakeErr != nil {
-			return "", fmt.Errorf("app %q: wake failed: %w", appName, info.wakeErr)
+	m.unhealthyIPs[ip] = true
+
+	var apps []string
+	for name, info := range m.vms {
+		if info.status == statusWaking {
+			continue
+		}
+		for _, n := range info.nodes {
+			if n.ip == ip {
+				info.stale = true
+				apps = append(apps, name)
+				break
+			}
 		}
-		return info.ip, nil
-	case <-timer.C:
-		return "", fmt.Errorf("app %q: wake timed out after %s", appName, timeout)
-	case <-ctx.Done():
-		return "", ctx.Err()
 	}
+	return apps
 }
 
-// doWake calls ResumeVM and trusts it's ready immediately (sub-second resume).
-func (m *vmStateManager) doWake(appName, hostname string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	err := m.client.ResumeVM(ctx, hostname)
-	m.finishWake(appName, err)
+// markHealthy clears an unhealthy report for ip.
+func (m *vmStateManager) markHealthy(ip string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.unhealthyIPs, ip)
 }
 
-func (m *vmStateManager) finishWake(appName string, err error) {
+// isUnhealthy reports whether ip was reported unhealthy.
+func (m *vmStateManager) isUnhealthy(ip string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.unhealthyIPs[ip]
+}
 
-	info, ok := m.vms[appName]
-	if !ok {
-		return
+// resumeVM calls ResumeVM, or RestoreVM for a suspended node, retrying
+// transient failures up to wakeRetries times with exponential backoff and
+// full jitter, within ctx.
+func (m *vmStateManager) resumeVM(ctx context.Context, appName string, n vmNode) error {
+	resume := m.client.ResumeVM
+	if n.suspended {
+		resume = m.client.RestoreVM
 	}
+	hostname := n.hostname
+	for attempt := 0; ; attempt++ {
+		err := resume(ctx, hostname)
+		if err == nil || attempt >= m.wakeRetries || !isTransient(err) {
+			return err
+		}
 
-	info.wakeErr = err
-	if err == nil {
-		info.status = statusRunning
-		m.logger.Info("VM resumed", zap.String("app", appName))
-	} else {
-		info.status = statusPaused
-		m.logger.Error("VM wake failed", zap.String("app", appName), zap.Error(err))
+		backoff := time.Duration(rand.Int64N(int64(m.wakeRetryBackoff<<attempt) + 1))
+		m.logger.Warn("resume VM failed, retrying",
+			zap.String("app", appName),
+			zap.String("hostname", hostname),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
 	}
+}
 
-	if info.wakeCh != nil {
-		close(info.wakeCh)
+// isTransient reports whether a failed Slicer call is worth retrying:
+// server errors and connection failures, but not client errors such as an
+// unknown VM.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	msg := err.Error()
+	if strings.HasPrefix(msg, "status 5") {
+		return true
 	}
+	return !strings.HasPrefix(msg, "status ") && !isNotFound(err)
 }
 
-func (m *vmStateManager) touchLastSeen(appName string) {
+// isAlreadyRunning reports whether err is Slicer refusing to resume a VM
+// because it is not paused. Slicer answers that with 409 Conflict, which
+// the SDK reports as "status 409 Conflict: <body>"; the body wording is
+// not part of the API, so only the status is matched.
+func isAlreadyRunning(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "status 409")
+}
+
+// isVMNotFound reports whether err is Slicer answering a call for a VM
+// with 404 Not Found, e.g. because it was renamed or moved to another host
+// group. As with isAlreadyRunning, only the status is matched.
+func isVMNotFound(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "status 404")
+}
+
+// markStale makes the next lookup of appName fetch its nodes again, e.g.
+// after Slicer no longer knows one of them under its cached hostname.
+func (m *vmStateManager) markStale(appName string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if info, ok := m.vms[appName]; ok {
-		info.lastSeen = time.Now()
+		info.stale = true
 	}
 }
 
-func (m *vmStateManager) idleApps(timeout time.Duration) []string {
+// isStale reports whether appName is marked stale.
+func (m *vmStateManager) isStale(appName string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-
-	now := time.Now()
-	var idle []string
-	for name, info := range m.vms {
-		if info.status == statusRunning && now.Sub(info.lastSeen) > timeout {
-			idle = append(idle, name)
-		}
-	}
-	return idle
+	info, ok := m.vms[appName]
+	return ok && info.stale
 }
 
-func (m *vmStateManager) markPaused(appName string) {
+// forgetNotFound drops a cached not-found entry for appName, if any.
+func (m *vmStateManager) forgetNotFound(appName string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if info, ok := m.vms[appName]; ok {
-		info.status = statusPaused
+	if info, ok := m.vms[appName]; ok && info.status == statusNotFound {
+		delete(m.vms, appName)
 	}
 }
 
-func (m *vmStateManager) getHostname(appName string) string {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if info, ok := m.vms[appName]; ok {
-		return info.hostname
+// isNotFound reports whether err means no VM is tagged for the app.
+func isNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not found")
+}
+
+// ensureRunning makes sure the VM for appName is running. If paused, it
+// initiates a resume and blocks until done.
+// Concurrent callers are coalesced - only one ResumeVM call is made.
+// A context that is already done (e.g. the client disconnected before the
+// handler ran) returns immediately without touching Slicer.
+func (m *vmStateManager) ensureRunning(ctx context.Context, appName string, timeout time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
-	return ""
+
+	ip, err := m.wake(ctx, appName, timeout)
+	if err != nil && m.isStale(appName) {
+		// The VM vanished under its cached hostname, e.g. it was moved to
+		// another host group. Search for it again once before giving up.
+		m.logger.Info("VM not found under cached hostname, searching again", zap.String("app", appName))
+		return m.wake(ctx, appName, timeout)
+	}
+	return ip, err
+}
+
+// wake looks appName up and resumes it, or joins the wake in progress.
+func (m *vmStateManager) wake(ctx context.Context, appName string, timeout time.Duration) (string, error) {
+	info, err := m.lookup(ctx, appName)
+	if err != nil {
+		return "", err
+	}
+	// A VM being paused is woken again once the pause is done, rather
+	// than handed out while it goes away.
+	if err := m.awaitPause(ctx, info); err != nil {
+		return "", err
+	}
+
+	switch info.status {
+	case statusNotFound:
+		return "", fmt.Errorf("app %q: not found", appName)
+	case statusRunning:
+		return info.ip, nil
+	case statusWaking:
+		return m.waitForWake(ctx, appName, info, timeout)
+	case statusPaused:
+		return m.initiateWake(ctx, appName, info, timeout)
+	case statusStarting:
+		return m.waitForStart(ctx, appName, timeout)
+	case statusStopped, statusError:
+		return "", &unavailableError{app: appName, status: info.status}
+	case statusUnknown:
+		return m.wakeUnknown(ctx, appName, timeout)
+	}
+
+	return "", fmt.Errorf("app %q: unexpected status", appName)
+}
+
+// wakeUnknown handles an app whose status is unknown, e.g. because Slicer
+// reported a state that has no mapping. The VM may be mid-transition, so
+// its status is fetched again once, and it is only resumed if it turns out
+// to be paused.
+func (m *vmStateManager) wakeUnknown(ctx context.Context, appName string, timeout time.Duration) (string, error) {
+	m.markStale(appName)
+	info, err := m.lookup(ctx, appName)
+	if err != nil {
+		return "", err
+	}
+	if info.status != statusUnknown {
+		return m.wake(ctx, appName, timeout)
+	}
+
+	m.mu.Lock()
+	var raw []string
+	for _, n := range info.nodes {
+		raw = append(raw, n.hostname+"="+n.raw)
+	}
+	m.mu.Unlock()
+	m.logger.Warn("VM status unknown, not resuming",
+		zap.String("app", appName),
+		zap.Strings("nodes", raw),
+	)
+	return "", fmt.Errorf("app %q: VM status %s is not resumable", appName, strings.Join(raw, ", "))
+}
+
+// wakeUnresolved handles a wake for an app whose cached entry lacks the VM
+// hostname to resume, e.g. because it was only partly populated. The app
+// is fetched again once, and woken only if that fills the hostname in.
+func (m *vmStateManager) wakeUnresolved(ctx context.Context, appName string, timeout time.Duration) (string, error) {
+	m.markStale(appName)
+	info, err := m.lookup(ctx, appName)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	resolved := info.resolved()
+	m.mu.Unlock()
+	if !resolved {
+		return "", fmt.Errorf("app %q: VM hostname unknown, not resuming", appName)
+	}
+	return m.wake(ctx, appName, timeout)
+}
+
+// startPollInterval is how often an app that Slicer is still provisioning
+// is looked up again while requests wait for it.
+const startPollInterval = time.Second
+
+// waitForStart waits for an app whose VM Slicer is provisioning or booting
+// to come up on its own, without resuming it, and then serves it like any
+// other wake.
+func (m *vmStateManager) waitForStart(ctx context.Context, appName string, timeout time.Duration) (string, error) {
+	m.logger.Debug("VM starting, waiting for it", zap.String("app", appName))
+	deadline := time.Now().Add(timeout)
+	timer := time.NewTimer(min(startPollInterval, timeout))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			slicerMetrics.wakeTimeouts.WithLabelValues(m.appHostGroup(appName), m.metricsApp(appName)).Inc()
+			return "", fmt.Errorf("app %q: wake timed out after %s", appName, timeout)
+		}
+
+		// Waiters share one fetch per interval.
+		m.mu.Lock()
+		if info, ok := m.vms[appName]; ok && time.Since(info.fetchedAt) >= startPollInterval {
+			info.stale = true
+		}
+		m.mu.Unlock()
+		info, err := m.lookup(ctx, appName)
+		if err != nil {
+			return "", err
+		}
+		if info.status != statusStarting {
+			return m.wake(ctx, appName, remaining)
+		}
+		timer.Reset(min(startPollInterval, remaining))
+	}
+}
+
+// runningIP returns the VM's IP if it is already running, without waking it.
+// The returned bool is false for VMs that are paused, waking or unknown. A
+// VM being paused is reported once the pause is done.
+func (m *vmStateManager) runningIP(ctx context.Context, appName string) (string, bool, error) {
+	info, err := m.lookup(ctx, appName)
+	if err != nil {
+		return "", false, err
+	}
+	if err := m.awaitPause(ctx, info); err != nil {
+		return "", false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch info.status {
+	case statusNotFound:
+		return "", false, fmt.Errorf("app %q: not found", appName)
+	case statusRunning:
+		if m.pauseDone(info) != nil {
+			return "", false, nil
+		}
+		return info.ip, true, nil
+	}
+	return "", false, nil
+}
+
+func (m *vmStateManager) initiateWake(ctx context.Context, appName string, info *vmInfo, timeout time.Duration) (string, error) {
+	m.mu.Lock()
+	if m.pauseDone(info) != nil {
+		// A pause started since wake looked: wait it out and start over.
+		m.mu.Unlock()
+		return m.wake(ctx, appName, timeout)
+	}
+	if info.status == statusWaking {
+		m.mu.Unlock()
+		return m.waitForWake(ctx, appName, info, timeout)
+	}
+	if info.status == statusRunning {
+		m.mu.Unlock()
+		return info.ip, nil
+	}
+	if !info.resolved() {
+		m.mu.Unlock()
+		return m.wakeUnresolved(ctx, appName, timeout)
+	}
+
+	if m.maintenance != nil && m.maintenance.Load() {
+		m.mu.Unlock()
+		return "", errMaintenance
+	}
+	if m.draining {
+		m.mu.Unlock()
+		return "", errShuttingDown
+	}
+
+	if remaining := time.Until(info.cooldownUntil); remaining > 0 {
+		m.mu.Unlock()
+		return "", &cooldownError{app: appName, remaining: remaining}
+	}
+
+	if reason := m.pressure(); reason != "" {
+		group := m.hostGroupOf(info)
+		m.mu.Unlock()
+		slicerMetrics.wakesShed.WithLabelValues(group).Inc()
+		return "", &shedError{app: appName, reason: reason}
+	}
+
+	from := info.status
+	info.status = statusWaking
+	info.wakeStarted = time.Now()
+	m.record(info, from, "wake", nil)
+	info.wakeCh = make(chan struct{})
+	info.wakeErr = nil
+	var nodes []vmNode
+	for _, n := range info.nodes {
+		if n.status == statusPaused {
+			nodes = append(nodes, *n)
+		}
+	}
+	if m.minReplicas > 0 && len(nodes) > m.minReplicas {
+		nodes = nodes[:m.minReplicas]
+	}
+	hostname := info.hostname
+	m.wakes.Add(1)
+	m.mu.Unlock()
+
+	m.emit(eventVMWaking, appName, hostname, nil)
+
+	m.logger.Info("waking VM", zap.String("app", appName), zap.Int("nodes", len(nodes)))
+	go func() {
+		defer m.wakes.Done()
+		m.doWake(appName, nodes)
+	}()
+
+	return m.waitForWake(ctx, appName, info, timeout)
+}
+
+func (m *vmStateManager) waitForWake(ctx context.Context, appName string, info *vmInfo, timeout time.Duration) (string, error) {
+	m.mu.Lock()
+	wakeCh, wakeErr := info.wakeCh, info.wakeErr
+	m.mu.Unlock()
+	if wakeCh == nil {
+		// The wake was abandoned by drain.
+		return "", fmt.Errorf("app %q: wake failed: %w", appName, wakeErr)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-wakeCh:
+		if info.wakeErr != nil {
+			return "", fmt.Errorf("app %q: wake failed: %w", appName, info.wakeErr)
+		}
+		return info.ip, nil
+	case <-timer.C:
+		slicerMetrics.wakeTimeouts.WithLabelValues(m.appHostGroup(appName), m.metricsApp(appName)).Inc()
+		return "", fmt.Errorf("app %q: wake timed out after %s", appName, timeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// doWake resumes the app's paused nodes in parallel, at most
+// wakeConcurrency at a time, and completes the wake as soon as the first of
+// them is ready, so cold-start latency is that of the fastest node. The
+// remaining nodes keep coming up in the background, staggered by the
+// concurrency limit, and join the node set as they become ready.
+func (m *vmStateManager) doWake(appName string, nodes []vmNode) {
+	// The wake's waiters give up after wakeTimeout, waiting for a slot
+	// included, so warmups must be done by then.
+	deadline := time.Now().Add(m.nodeWakeTimeout())
+
+	if m.wakeSlots != nil {
+		select {
+		case m.wakeSlots <- struct{}{}:
+		default:
+			m.logger.Debug("wake queued for a free slot", zap.String("app", appName))
+			select {
+			case m.wakeSlots <- struct{}{}:
+			case <-m.ctx.Done():
+				m.finishWake(appName, fmt.Errorf("waiting for a wake slot: %w", m.ctx.Err()))
+				return
+			}
+		}
+		defer func() { <-m.wakeSlots }()
+	}
+
+	type result struct {
+		node vmNode
+		err  error
+	}
+
+	slots := make(chan struct{}, max(m.wakeConcurrency, 1))
+	results := make(chan result, len(nodes))
+	for _, n := range nodes {
+		go func(n vmNode) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results <- result{node: n, err: m.wakeNode(appName, n)}
+		}(n)
+	}
+
+	var failed result
+	woke := false
+	for range nodes {
+		res := <-results
+		switch {
+		case res.err != nil:
+			failed = res
+		case !woke:
+			woke = true
+			m.warmup(appName, res.node.ip, deadline)
+			m.finishWake(appName, nil)
+			m.emit(eventVMRunning, appName, res.node.hostname, nil)
+		}
+	}
+	if !woke {
+		m.finishWake(appName, failed.err)
+		m.emit(eventVMWakeFailed, appName, failed.node.hostname, map[string]any{"error": fmt.Sprint(failed.err)})
+	}
+}
+
+// nodeWakeTimeout returns how long a wake may take: wakeTimeout, or 30s if
+// the state manager is used without one.
+func (m *vmStateManager) nodeWakeTimeout() time.Duration {
+	if m.wakeTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return m.wakeTimeout
+}
+
+// resumeNode resumes n within resumeTimeout, if set.
+func (m *vmStateManager) resumeNode(ctx context.Context, appName string, n vmNode) error {
+	if m.resumeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.resumeTimeout)
+		defer cancel()
+	}
+	return m.resumeVM(ctx, appName, n)
+}
+
+// wakeNode calls ResumeVM for one node and, if a readiness probe is
+// configured, waits for the app on it to pass. Without a probe the node is
+// trusted to be ready as soon as ResumeVM returns (sub-second resume).
+func (m *vmStateManager) wakeNode(appName string, n vmNode) error {
+	ctx, cancel := context.WithTimeout(m.ctx, m.nodeWakeTimeout())
+	defer cancel()
+
+	var err error
+	if m.probeFirst && m.probe != nil && m.probe.check(ctx, m.probeAddr(appName, n.ip)) == nil {
+		m.logger.Debug("node already serving, skipping resume",
+			zap.String("app", appName),
+			zap.String("hostname", n.hostname),
+		)
+	} else if err = m.resumeNode(ctx, appName, n); isAlreadyRunning(err) {
+		// The cache thought the VM was paused but it is not, e.g. a
+		// pause failed silently or it was resumed outside this module.
+		m.logger.Info("VM was already running",
+			zap.String("app", appName),
+			zap.String("hostname", n.hostname),
+		)
+		err = nil
+	}
+	if err == nil && m.probe != nil {
+		if err = m.probe.wait(ctx, m.probeAddr(appName, n.ip)); err != nil && m.probe.port != m.appPort {
+			m.diagnoseProbe(appName, n.ip, err)
+		}
+	}
+	if err != nil {
+		m.logger.Warn("node wake failed",
+			zap.String("app", appName),
+			zap.String("hostname", n.hostname),
+			zap.Error(err),
+		)
+		if isVMNotFound(err) {
+			m.markStale(appName)
+		}
+		return fmt.Errorf("node %q: %w", n.hostname, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.probe != nil {
+		delete(m.unhealthyIPs, n.ip)
+	}
+	if info, ok := m.vms[appName]; ok {
+		for _, node := range info.nodes {
+			if node.hostname == n.hostname {
+				node.status = statusRunning
+				node.suspended = false
+			}
+		}
+		if info.status != statusRunning {
+			// Route to the first node that came up.
+			info.hostname = n.hostname
+			info.ip = n.ip
+		}
+	}
+	return nil
+}
+
+// diagnoseProbe logs whether the app port is reachable when a readiness
+// probe on a different port failed, to tell a wrong ready_check_port from
+// an app that is genuinely not ready.
+func (m *vmStateManager) diagnoseProbe(appName, ip string, probeErr error) {
+	appAddr := net.JoinHostPort(ip, strconv.Itoa(m.portFor(appName)))
+	conn, err := net.DialTimeout("tcp", appAddr, time.Second)
+	if err != nil {
+		m.logger.Warn("readiness probe failed and app port is unreachable",
+			zap.String("app", appName),
+			zap.String("probe_addr", m.probe.addr(ip)),
+			zap.NamedError("probe_error", probeErr),
+			zap.String("app_addr", appAddr),
+			zap.NamedError("app_error", err),
+		)
+		return
+	}
+	conn.Close()
+	m.logger.Warn("readiness probe failed but app port is reachable, check ready_check_port",
+		zap.String("app", appName),
+		zap.String("probe_addr", m.probe.addr(ip)),
+		zap.NamedError("probe_error", probeErr),
+		zap.String("app_addr", appAddr),
+	)
+}
+
+// portFor returns the port appName listens on, trying the full name before
+// its first label and falling back to appPort.
+func (m *vmStateManager) portFor(appName string) int {
+	if port, ok := m.appPorts[appName]; ok {
+		return port
+	}
+	if port, ok := m.appPorts[firstLabel(appName)]; ok {
+		return port
+	}
+	return m.appPort
+}
+
+// probeAddr returns the readiness probe address for appName's node at ip.
+// A probe on the global app port follows the app's port override.
+func (m *vmStateManager) probeAddr(appName, ip string) string {
+	if m.probe.port == m.appPort {
+		return net.JoinHostPort(ip, strconv.Itoa(m.portFor(appName)))
+	}
+	return m.probe.addr(ip)
+}
+
+func (m *vmStateManager) finishWake(appName string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, ok := m.vms[appName]
+	if !ok {
+		return
+	}
+
+	info.wakeErr = err
+	result := wakeResultSuccess
+	if err != nil {
+		result = wakeResultFailure
+	}
+	group := m.hostGroupOf(info)
+	slicerMetrics.wakes.WithLabelValues(group, m.metricsApp(appName), result).Inc()
+	slicerMetrics.wakeDuration.WithLabelValues(group, m.metricsApp(appName), result).
+		Observe(time.Since(info.wakeStarted).Seconds())
+
+	if err == nil {
+		info.coldStarts++
+		info.wakeTime += time.Since(info.wakeStarted)
+		info.status = statusRunning
+		info.healthySince = time.Now()
+		info.runningSince = info.healthySince
+		m.logger.Info("VM resumed", zap.String("app", appName))
+		m.record(info, statusWaking, "resumed", nil)
+		if !info.pausedAt.IsZero() {
+			paused := time.Since(info.pausedAt)
+			info.pausedAt = time.Time{}
+			slicerMetrics.pausedDuration.WithLabelValues(group).Observe(paused.Seconds())
+			m.logger.Debug("VM was paused before wake",
+				zap.String("app", appName),
+				zap.Duration("paused_for", paused),
+			)
+		}
+	} else {
+		info.status = statusPaused
+		info.lastWakeError = err.Error()
+		info.lastWakeErrorAt = time.Now()
+		m.record(info, statusWaking, "wake failed", err)
+		m.logger.Error("VM wake failed", zap.String("app", appName), zap.Error(err))
+		if !info.stale {
+			// A VM that vanished is looked up again rather than backed off.
+			m.startCooldown(appName, info)
+		}
+	}
+
+	if info.wakeCh != nil {
+		close(info.wakeCh)
+	}
+}
+
+// errShuttingDown fails wakes abandoned by drain, and wakes started once it
+// has begun.
+var errShuttingDown = errors.New("handler is shutting down")
+
+// errMaintenance fails wakes and manual pauses in maintenance mode.
+var errMaintenance = errors.New("maintenance mode: VMs are not woken or paused")
+
+// drain waits up to timeout for the wakes in progress to finish, so a
+// config reload does not leave their goroutines and waiters behind. Wakes
+// still running after that are cancelled and their waiters released with
+// errShuttingDown, which also refuses wakes requested once drain starts.
+func (m *vmStateManager) drain(timeout time.Duration) {
+	m.mu.Lock()
+	m.draining = true
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wakes.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		m.cancel()
+		return
+	case <-timer.C:
+	}
+
+	m.cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for appName, info := range m.vms {
+		if info.status != statusWaking || info.wakeCh == nil {
+			continue
+		}
+		m.logger.Warn("abandoning wake on shutdown", zap.String("app", appName))
+		info.status = statusUnknown
+		info.wakeErr = errShuttingDown
+		close(info.wakeCh)
+		info.wakeCh = nil
+	}
+}
+
+// pressure returns why a new wake should be shed, or "" to admit it.
+// Called with m.mu held.
+func (m *vmStateManager) pressure() string {
+	if m.shedMaxWaking <= 0 && m.shedMaxRunning <= 0 {
+		return ""
+	}
+	waking := m.countVMs(statusWaking)
+	if m.shedMaxWaking > 0 && waking >= m.shedMaxWaking {
+		return fmt.Sprintf("%d VMs already waking", waking)
+	}
+	if m.shedMaxRunning > 0 {
+		if active := waking + m.countVMs(statusRunning); active >= m.shedMaxRunning {
+			return fmt.Sprintf("%d VMs already running or waking", active)
+		}
+	}
+	return ""
+}
+
+// countVMs returns the number of distinct VMs in status. Several entries can
+// point at the same VM, so they are counted by hostname. Called with m.mu held.
+func (m *vmStateManager) countVMs(status vmStatus) int {
+	seen := make(map[string]bool)
+	for _, info := range m.vms {
+		if info.status == status {
+			seen[info.hostname] = true
+		}
+	}
+	return len(seen)
+}
+
+// startCooldown records a failed wake and, if cooldowns are enabled and
+// wakeFailureThreshold wakes in a row have failed, blocks further wakes for
+// an exponentially growing period. The failure count resets once the VM
+// has stayed up for wakeCooldownMax after a good wake. Called with m.mu
+// held.
+func (m *vmStateManager) startCooldown(appName string, info *vmInfo) {
+	if m.wakeCooldown <= 0 {
+		return
+	}
+
+	if !info.healthySince.IsZero() && time.Since(info.healthySince) >= m.wakeCooldownMax {
+		info.wakeFailures = 0
+	}
+	info.healthySince = time.Time{}
+	info.wakeFailures++
+	if info.wakeFailures < m.wakeFailureThreshold {
+		return
+	}
+
+	cooldown := m.wakeCooldown
+	for i := max(m.wakeFailureThreshold, 1); i < info.wakeFailures && cooldown < m.wakeCooldownMax; i++ {
+		cooldown *= 2
+	}
+	cooldown = min(cooldown, m.wakeCooldownMax)
+	info.cooldownUntil = time.Now().Add(cooldown)
+
+	m.logger.Warn("app wake cooldown started",
+		zap.String("app", appName),
+		zap.Int("consecutive_failures", info.wakeFailures),
+		zap.Duration("cooldown", cooldown),
+	)
+}
+
+func (m *vmStateManager) touchLastSeen(appName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.vms[appName]; ok {
+		info.lastSeen = time.Now()
+		info.idleSweeps = 0
+	}
+}
+
+// beginRequest records activity and a request being proxied to appName. It
+// reports false, recording nothing, if the VM stopped running or started
+// being paused since it was woken for the request; the caller wakes it
+// again. Registering under the lock beginPause takes means a pause either
+// sees the request or the request sees the pause.
+func (m *vmStateManager) beginRequest(appName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.vms[appName]
+	if !ok {
+		return true
+	}
+	if info.status != statusRunning || m.pauseDone(info) != nil {
+		return false
+	}
+	info.requests++
+	info.served++
+	info.lastSeen = time.Now()
+	info.idleSweeps = 0
+	return true
+}
+
+// endRequest records a proxied request finishing and returns how many
+// requests to appName are still in flight. When the last one finishes the
+// idle timer restarts, so a long-lived connection is not followed by an
+// immediate pause.
+func (m *vmStateManager) endRequest(appName string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.vms[appName]
+	if !ok {
+		return 0
+	}
+	if info.requests > 0 {
+		info.requests--
+	}
+	if info.requests == 0 {
+		info.lastSeen = time.Now()
+	}
+	return info.requests
+}
+
+// keepWarmUntil prevents appName from being considered idle before until.
+func (m *vmStateManager) keepWarmUntil(appName string, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.vms[appName]; ok && until.After(info.warmUntil) {
+		info.warmUntil = until
+	}
+}
+
+// idleApps returns running apps that have been idle for longer than timeout
+// on at least confirmations consecutive calls. Several cache entries (e.g. a
+// wildcard subdomain and a custom domain) can point at the same VM; the VM is
+// only reported once, and only if none of its entries are active.
+func (m *vmStateManager) idleApps(timeout time.Duration, confirmations int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	busy := make(map[string]bool)
+	var candidates []string
+	for name, info := range m.vms {
+		if info.status != statusRunning {
+			info.idleSweeps = 0
+			continue
+		}
+		// Requests still in flight, such as WebSocket or SSE streams,
+		// keep the app busy however long ago they started.
+		if info.requests > 0 || idleFor(now, info.lastSeen) <= timeout || now.Before(info.warmUntil) ||
+			now.Before(info.runningSince.Add(m.minRunningTime)) {
+			info.idleSweeps = 0
+			busy[info.hostname] = true
+			continue
+		}
+		info.idleSweeps++
+		if info.idleSweeps >= confirmations {
+			candidates = append(candidates, name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var idle []string
+	for _, name := range candidates {
+		hostname := m.vms[name].hostname
+		if busy[hostname] || seen[hostname] {
+			continue
+		}
+		seen[hostname] = true
+		idle = append(idle, name)
+	}
+	return idle
+}
+
+// beginPause claims the node hostname for a pause, so requests wait for
+// the pause to finish instead of being proxied to a VM that is going away.
+// It reports false, claiming nothing, if no entry has the node any more,
+// one of them is waking or the node is already being paused. Unless minIdle
+// is negative it also refuses while any entry for the node has a request
+// in flight or, with a positive minIdle, saw activity within minIdle or is
+// held warm. endPause releases the claim.
+func (m *vmStateManager) beginPause(hostname string, minIdle time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pausing[hostname]; ok {
+		return false
+	}
+	now := time.Now()
+	found := false
+	for _, info := range m.vms {
+		if !slices.ContainsFunc(info.nodes, func(n *vmNode) bool { return n.hostname == hostname }) {
+			continue
+		}
+		found = true
+		if info.status == statusWaking {
+			return false
+		}
+		if minIdle < 0 {
+			continue
+		}
+		if info.requests > 0 {
+			return false
+		}
+		if minIdle > 0 && (idleFor(now, info.lastSeen) <= minIdle || now.Before(info.warmUntil)) {
+			return false
+		}
+	}
+	if !found {
+		return false
+	}
+	m.pausing[hostname] = make(chan struct{})
+	return true
+}
+
+// endPause releases the claim taken by beginPause and lets the requests
+// waiting on it go on, after markPaused has recorded a successful pause.
+func (m *vmStateManager) endPause(hostname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if done, ok := m.pausing[hostname]; ok {
+		close(done)
+		delete(m.pausing, hostname)
+	}
+}
+
+// pauseDone returns the channel closed when the pause of one of info's
+// nodes finishes, or nil if none is being paused. Called with m.mu held.
+func (m *vmStateManager) pauseDone(info *vmInfo) <-chan struct{} {
+	for _, n := range info.nodes {
+		if done, ok := m.pausing[n.hostname]; ok {
+			return done
+		}
+	}
+	return nil
+}
+
+// awaitPause waits until no node of info is being paused.
+func (m *vmStateManager) awaitPause(ctx context.Context, info *vmInfo) error {
+	for {
+		m.mu.Lock()
+		done := m.pauseDone(info)
+		m.mu.Unlock()
+		if done == nil {
+			return nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// expiredApps returns running apps that have been running continuously for
+// longer than lifetime, regardless of activity. Like idleApps it reports each
+// VM once, and it skips VMs with requests in flight so they can drain.
+func (m *vmStateManager) expiredApps(lifetime time.Duration) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	busy := make(map[string]bool)
+	var candidates []string
+	for name, info := range m.vms {
+		if info.status != statusRunning {
+			continue
+		}
+		if info.requests > 0 {
+			busy[info.hostname] = true
+			continue
+		}
+		if !info.runningSince.IsZero() && idleFor(now, info.runningSince) > lifetime {
+			candidates = append(candidates, name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var expired []string
+	for _, name := range candidates {
+		hostname := m.vms[name].hostname
+		if busy[hostname] || seen[hostname] {
+			continue
+		}
+		seen[hostname] = true
+		expired = append(expired, name)
+	}
+	return expired
+}
+
+// appNode is a node of an app, as picked by idleNodes for pausing.
+type appNode struct {
+	app      string
+	hostname string
+}
+
+// idleNodes returns the running nodes of the idle apps, each VM once. With
+// a target above zero, a node is only returned while more than target VMs
+// would stay running in its host group, taking the least recently used
+// apps first, so replicated apps cannot take a group below the target.
+func (m *vmStateManager) idleNodes(idle []string, target int) []appNode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	apps := make([]string, 0, len(idle))
+	for _, app := range idle {
+		if _, ok := m.vms[app]; ok {
+			apps = append(apps, app)
+		}
+	}
+	var excess map[string]int
+	if target > 0 {
+		sort.SliceStable(apps, func(i, j int) bool {
+			return m.vms[apps[i]].lastSeen.Before(m.vms[apps[j]].lastSeen)
+		})
+		excess = m.runningByGroup()
+		for group := range excess {
+			excess[group] -= target
+		}
+	}
+
+	seen := make(map[string]bool)
+	var nodes []appNode
+	for _, app := range apps {
+		info := m.vms[app]
+		group := m.hostGroupOf(info)
+		for _, n := range info.nodes {
+			if n.status != statusRunning || seen[n.hostname] {
+				continue
+			}
+			if excess != nil {
+				if excess[group] <= 0 {
+					break
+				}
+				excess[group]--
+			}
+			seen[n.hostname] = true
+			nodes = append(nodes, appNode{app: app, hostname: n.hostname})
+		}
+	}
+	return nodes
+}
+
+// runningByGroup returns the number of distinct running VMs in each host
+// group. Called with m.mu held.
+func (m *vmStateManager) runningByGroup() map[string]int {
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, info := range m.vms {
+		for _, n := range info.nodes {
+			if n.status == statusRunning && !seen[n.hostname] {
+				seen[n.hostname] = true
+				counts[m.hostGroupOf(info)]++
+			}
+		}
+	}
+	return counts
+}
+
+// hostGroupOf returns the host group info's VMs were found in, or the
+// primary group if it is not known, e.g. with a single group or no VMs.
+// Called with m.mu held.
+func (m *vmStateManager) hostGroupOf(info *vmInfo) string {
+	if info.hostGroup != "" {
+		return info.hostGroup
+	}
+	return m.primaryGroup()
+}
+
+// primaryGroup returns the first configured host group.
+func (m *vmStateManager) primaryGroup() string {
+	if len(m.hostGroups) > 0 {
+		return m.hostGroups[0]
+	}
+	return m.hostGroup
+}
+
+// runningVMs returns the number of distinct running VMs in each host
+// group, with every configured group present.
+func (m *vmStateManager) runningVMs() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.runningByGroup()
+	for _, group := range m.hostGroups {
+		counts[group] += 0
+	}
+	return counts
+}
+
+// vmsByStatus returns the number of distinct VMs in each status, per host
+// group, with every configured group and status present. Apps with no VM
+// count once each under statusNotFound in the primary group.
+func (m *vmStateManager) vmsByStatus() map[string]map[vmStatus]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]map[vmStatus]int)
+	byGroup := func(group string) map[vmStatus]int {
+		if _, ok := counts[group]; !ok {
+			counts[group] = map[vmStatus]int{
+				statusUnknown: 0, statusRunning: 0, statusPaused: 0, statusWaking: 0, statusNotFound: 0,
+				statusStarting: 0, statusStopped: 0, statusError: 0,
+			}
+		}
+		return counts[group]
+	}
+	for _, group := range m.hostGroups {
+		byGroup(group)
+	}
+	seen := make(map[string]bool)
+	for appName, info := range m.vms {
+		key := info.hostname
+		if key == "" {
+			key = appName
+		}
+		if !seen[key] {
+			seen[key] = true
+			byGroup(m.hostGroupOf(info))[info.status]++
+		}
+	}
+	return counts
+}
+
+// appHostGroup returns the host group label for appName's metrics: the
+// group its VMs were found in, or the primary group.
+func (m *vmStateManager) appHostGroup(appName string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.vms[appName]; ok {
+		return m.hostGroupOf(info)
+	}
+	return m.primaryGroup()
+}
+
+// metricsApp returns the app label for per-app metrics, or "" unless
+// metricsPerApp is set, to keep label cardinality bounded by default.
+func (m *vmStateManager) metricsApp(appName string) string {
+	if !m.metricsPerApp {
+		return ""
+	}
+	return appName
+}
+
+// idleFor returns how long ago lastSeen was, robust against wall clock
+// adjustments. Sub uses the monotonic clock when both times carry a reading,
+// but times that lost it (e.g. after Round or persistence) fall back to wall
+// clock. Taking the smaller of the two means a clock jump can only make a VM
+// look more recently active, never spuriously idle.
+func idleFor(now, lastSeen time.Time) time.Duration {
+	elapsed := now.Sub(lastSeen)
+	if wall := now.Round(0).Sub(lastSeen.Round(0)); wall < elapsed {
+		elapsed = wall
+	}
+	if elapsed < 0 {
+		return 0
+	}
+	return elapsed
+}
+
+// markPaused marks the node hostname paused in appName and in any other
+// entries for the same VM. An app is paused once none of its nodes are
+// running. reason is recorded in the state history.
+func (m *vmStateManager) markPaused(appName, hostname, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.vms[appName]; !ok {
+		return
+	}
+	now := time.Now()
+	for _, info := range m.vms {
+		found := false
+		for _, n := range info.nodes {
+			if n.hostname == hostname {
+				n.status = statusPaused
+				found = true
+			}
+		}
+		if !found || info.status != statusRunning {
+			continue
+		}
+		info.refresh()
+		if info.status == statusPaused {
+			info.pausedAt = now
+			info.runningSince = time.Time{}
+			m.record(info, statusRunning, reason, nil)
+		}
+	}
+}
+
+// markSuspended marks the paused node hostname suspended to disk in every
+// entry for the same VM, so its next wake restores it.
+func (m *vmStateManager) markSuspended(hostname, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, info := range m.vms {
+		for _, n := range info.nodes {
+			if n.hostname == hostname && n.status == statusPaused && !n.suspended {
+				n.suspended = true
+				m.record(info, info.status, reason, nil)
+			}
+		}
+	}
+}
+
+// deepIdleNodes returns the paused, not yet suspended nodes of apps that
+// have been paused for longer than timeout, each VM once.
+func (m *vmStateManager) deepIdleNodes(timeout time.Duration) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	nodes := make(map[string]string) // hostname -> app
+	for name, info := range m.vms {
+		if info.status != statusPaused || info.pausedAt.IsZero() || idleFor(now, info.pausedAt) <= timeout {
+			continue
+		}
+		for _, n := range info.nodes {
+			if n.status == statusPaused && !n.suspended {
+				nodes[n.hostname] = name
+			}
+		}
+	}
+	return nodes
+}
+
+// vmState is the exported view of one cached app, as served by the admin
+// API.
+type vmState struct {
+	App       string    `json:"app"`
+	HostGroup string    `json:"host_group"`
+	Hostname  string    `json:"hostname"`
+	IP        string    `json:"ip"`
+	Status    vmStatus  `json:"status"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	Requests        uint64    `json:"requests"`
+	ColdStarts      uint64    `json:"cold_starts"`
+	LastWakeError   string    `json:"last_wake_error,omitempty"`
+	LastWakeErrorAt time.Time `json:"last_wake_error_at,omitzero"`
+}
+
+// snapshot returns the cached state of every app, sorted by app name.
+func (m *vmStateManager) snapshot() []vmState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make([]vmState, 0, len(m.vms))
+	for appName, info := range m.vms {
+		states = append(states, vmState{
+			App:       appName,
+			HostGroup: m.hostGroupOf(info),
+			Hostname:  info.hostname,
+			IP:        info.ip,
+			Status:    info.status,
+			LastSeen:  info.lastSeen,
+
+			Requests:        info.served,
+			ColdStarts:      info.coldStarts,
+			LastWakeError:   info.lastWakeError,
+			LastWakeErrorAt: info.lastWakeErrorAt,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].App < states[j].App })
+	return states
+}
+
+// expectedWakeRemaining estimates how long appName's wake has left from
+// the average of its successful wakes, counting from the start of the
+// current wake when one is running. It reports false if the app has not
+// woken before.
+func (m *vmStateManager) expectedWakeRemaining(appName string) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.vms[appName]
+	if !ok || info.coldStarts == 0 {
+		return 0, false
+	}
+	remaining := info.wakeTime / time.Duration(info.coldStarts)
+	if info.status == statusWaking {
+		remaining -= time.Since(info.wakeStarted)
+	}
+	return remaining, true
+}
+
+// statusOf returns the cached status of appName, or statusUnknown if it
+// has not been looked up.
+func (m *vmStateManager) statusOf(appName string) vmStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.vms[appName]; ok {
+		return info.status
+	}
+	return statusUnknown
+}
+
+// cachedState returns appName's cached status and IP without looking it up.
+// The bool is false if appName is not cached.
+func (m *vmStateManager) cachedState(appName string) (vmStatus, string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.vms[appName]; ok {
+		return info.status, info.ip, true
+	}
+	return statusUnknown, "", false
+}
+
+// upstreamNode returns the hostname and IP of the node a request for
+// appName is proxied to: the primary node or, with roundRobin, the next
+// running node in turn.
+func (m *vmStateManager) upstreamNode(appName string) (string, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.vms[appName]
+	if !ok {
+		return "", ""
+	}
+	if m.roundRobin {
+		var running []*vmNode
+		for _, n := range info.nodes {
+			if n.status == statusRunning {
+				running = append(running, n)
+			}
+		}
+		if len(running) > 0 {
+			n := running[info.nextNode%len(running)]
+			info.nextNode++
+			return n.hostname, n.ip
+		}
+	}
+	return info.hostname, info.ip
+}
+
+// runningNodes returns the hostnames of appName's running nodes.
+func (m *vmStateManager) runningNodes(appName string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.vms[appName]
+	if !ok {
+		return nil
+	}
+	var hostnames []string
+	for _, n := range info.nodes {
+		if n.status == statusRunning {
+			hostnames = append(hostnames, n.hostname)
+		}
+	}
+	return hostnames
 }
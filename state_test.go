@@ -0,0 +1,354 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceStopsWakesAndPauses(t *testing.T) {
+	f := newFakeSlicer(t)
+	f.addNode("apps-2", "127.0.0.2", "Running", "other")
+	rs := newTestHandler(t, f, "idle_timeout 1h")
+	rs.maintenance.Store(true)
+
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); !errors.Is(err, errMaintenance) {
+		t.Fatalf("ensureRunning error = %v, want errMaintenance", err)
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 0 {
+		t.Fatalf("resumed %d times in maintenance", n)
+	}
+
+	if ip, err := rs.stateMgr.ensureRunning(t.Context(), "other", time.Second); err != nil || ip != "127.0.0.2" {
+		t.Fatalf("ensureRunning of a running VM = %q, %v", ip, err)
+	}
+	if pauseApp(t.Context(), rs, "other", "manual", -1) {
+		t.Fatal("pauseApp succeeded in maintenance")
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-2/pause"); n != 0 {
+		t.Fatalf("paused %d times in maintenance", n)
+	}
+}
+
+func TestWakeUnresolvedHostname(t *testing.T) {
+	f := newFakeSlicer(t)
+	f.setNodes(map[string]any{"hostname": "", "ip": "127.0.0.1", "status": "Paused", "tags": []string{"myapp"}})
+	var resumed []string
+	f.onResume = func(hostname string) (int, string) {
+		resumed = append(resumed, hostname)
+		return 0, ""
+	}
+	rs := newTestHandler(t, f, "idle_timeout 1h")
+
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); err == nil {
+		t.Fatal("woke a VM whose hostname Slicer has not reported")
+	}
+
+	f.setNodes(map[string]any{"hostname": "apps-1", "ip": "127.0.0.1", "status": "Paused", "tags": []string{"myapp"}})
+	if ip, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); err != nil || ip != "127.0.0.1" {
+		t.Fatalf("ensureRunning once resolved = %q, %v", ip, err)
+	}
+
+	if n := f.count(http.MethodPost, "/vm//resume"); n != 0 {
+		t.Errorf("ResumeVM called with an empty hostname %d times", n)
+	}
+	if len(resumed) != 1 || resumed[0] != "apps-1" {
+		t.Errorf("resumed %q, want [apps-1]", resumed)
+	}
+}
+
+func TestWakeAlreadyRunning(t *testing.T) {
+	f := newFakeSlicer(t)
+	f.onResume = func(string) (int, string) { return http.StatusConflict, "vm is not in a resumable state" }
+	rs := newTestHandler(t, f, "idle_timeout 1h\nwake_retries 0")
+
+	ip, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second)
+	if err != nil || ip != "127.0.0.1" {
+		t.Fatalf("ensureRunning = %q, %v, want the VM's IP", ip, err)
+	}
+	if got := rs.stateMgr.statusOf("myapp"); got != statusRunning {
+		t.Fatalf("status = %v, want running", got)
+	}
+
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("status 409 Conflict: vm is not in a resumable state"), true},
+		{errors.New("status 409 Conflict: "), true},
+		{errors.New("status 400 Bad Request: VM is already running"), false},
+		{errors.New("status 500 Internal Server Error: not paused"), false},
+		{nil, false},
+	} {
+		if got := isAlreadyRunning(tt.err); got != tt.want {
+			t.Errorf("isAlreadyRunning(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestEnsureRunningCancelledContext(t *testing.T) {
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := rs.stateMgr.ensureRunning(ctx, "myapp", time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ensureRunning error = %v, want context.Canceled", err)
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 0 {
+		t.Fatalf("resumed %d times for a cancelled request", n)
+	}
+}
+
+func TestIdleForClockSkew(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		lastSeen time.Time
+		want     time.Duration
+	}{
+		{"monotonic", now.Add(-time.Hour), time.Hour},
+		{"wall clock only", now.Round(0).Add(-time.Hour), time.Hour},
+		// A lastSeen ahead of now, e.g. persisted before the clock was
+		// stepped back, counts as just seen rather than as negative idle.
+		{"in the future", now.Round(0).Add(10 * time.Minute), 0},
+		{"in the future, monotonic", now.Add(10 * time.Minute), 0},
+	}
+	for _, tt := range tests {
+		if got := idleFor(now, tt.lastSeen); got != tt.want {
+			t.Errorf("%s: idleFor = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIdleAppsClockSkew(t *testing.T) {
+	f := newFakeSlicer(t)
+	f.setNodes(map[string]any{"hostname": "apps-1", "ip": "127.0.0.1", "status": "Running", "tags": []string{"myapp"}})
+	rs := newTestHandler(t, f, "idle_timeout 1h")
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	setLastSeen := func(d time.Duration) {
+		rs.stateMgr.mu.Lock()
+		rs.stateMgr.vms["myapp"].lastSeen = time.Now().Round(0).Add(d)
+		rs.stateMgr.mu.Unlock()
+	}
+	sweep := func() bool { return len(rs.stateMgr.idleApps(time.Hour, 2)) == 1 }
+
+	setLastSeen(2 * time.Hour)
+	if sweep() || sweep() {
+		t.Fatal("app seen in the future reported idle")
+	}
+
+	setLastSeen(-2 * time.Hour)
+	if sweep() {
+		t.Fatal("reported idle after one sweep, want two confirmations")
+	}
+	// The clock steps back past lastSeen between the confirmations: the app
+	// looks active again and its count starts over.
+	setLastSeen(time.Minute)
+	if sweep() {
+		t.Fatal("reported idle after the clock stepped back")
+	}
+	setLastSeen(-2 * time.Hour)
+	if sweep() {
+		t.Fatal("confirmations not reset by the clock step")
+	}
+	if !sweep() {
+		t.Fatal("not reported idle after two confirmations")
+	}
+}
+
+func TestDoWakeFirstNodeWins(t *testing.T) {
+	delays := map[string]time.Duration{"apps-1": 0, "apps-2": 50 * time.Millisecond, "apps-3": 500 * time.Millisecond}
+	tests := []struct {
+		name    string
+		fail    map[string]bool
+		wantErr bool
+	}{
+		{name: "fastest fails", fail: map[string]bool{"apps-1": true}},
+		{name: "slowest only", fail: map[string]bool{"apps-1": true, "apps-2": true}},
+		{name: "all fail", fail: map[string]bool{"apps-1": true, "apps-2": true, "apps-3": true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSlicer(t)
+			f.setNodes()
+			for i := 1; i <= 3; i++ {
+				f.addNode(fmt.Sprintf("apps-%d", i), fmt.Sprintf("127.0.0.%d", i), "Paused", "myapp")
+			}
+			var mu sync.Mutex
+			started := make(map[string]time.Time)
+			f.onResume = func(hostname string) (int, string) {
+				mu.Lock()
+				started[hostname] = time.Now()
+				mu.Unlock()
+				time.Sleep(delays[hostname])
+				if tt.fail[hostname] {
+					return http.StatusBadRequest, "cannot resume"
+				}
+				return 0, ""
+			}
+			rs := newTestHandler(t, f, "idle_timeout 1h\nwake_retries 0")
+
+			start := time.Now()
+			ip, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", 5*time.Second)
+			took := time.Since(start)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ensureRunning = %q, want an error when every node fails", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The wake returns as soon as the fastest node that succeeds is
+			// up, without waiting for the others.
+			fastest := 500 * time.Millisecond
+			if !tt.fail["apps-2"] {
+				fastest = 50 * time.Millisecond
+			}
+			if took < fastest || took > fastest+300*time.Millisecond {
+				t.Errorf("wake took %v, want about %v", took, fastest)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(started) != 3 {
+				t.Fatalf("resumed %d nodes, want 3", len(started))
+			}
+			for hostname, at := range started {
+				if d := at.Sub(start); d > 100*time.Millisecond {
+					t.Errorf("%s resumed %v after the wake began, want in parallel", hostname, d)
+				}
+			}
+			if ip == "" {
+				t.Error("ensureRunning returned no IP")
+			}
+		})
+	}
+}
+
+func TestWakeNodeConcurrency(t *testing.T) {
+	const nodes, limit = 6, 2
+
+	f := newFakeSlicer(t)
+	f.setNodes()
+	for i := 1; i <= nodes; i++ {
+		f.addNode(fmt.Sprintf("apps-%d", i), fmt.Sprintf("127.0.0.%d", i), "Paused", "myapp")
+	}
+	var mu sync.Mutex
+	var inFlight, peak, resumed int
+	f.onResume = func(string) (int, string) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		resumed++
+		mu.Unlock()
+		return 0, ""
+	}
+	rs := newTestHandler(t, f, fmt.Sprintf("idle_timeout 1h\nwake_node_concurrency %d", limit))
+
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 2*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return resumed == nodes
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak != limit {
+		t.Errorf("%d nodes resumed at once, want %d", peak, limit)
+	}
+}
+
+func TestWakeAfterHostGroupChange(t *testing.T) {
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h\nhost_group batch")
+	if _, err := rs.stateMgr.lookup(t.Context(), "myapp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The VM is moved to the batch group under a new hostname while the
+	// cache still knows it as apps-1.
+	f.setNodes(map[string]any{"hostname": "batch-1", "ip": "127.0.0.9", "status": "Paused", "tags": []string{"myapp"}})
+
+	ip, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "127.0.0.9" {
+		t.Errorf("ip = %q, want the moved VM's 127.0.0.9", ip)
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 1 {
+		t.Errorf("resumed the stale hostname %d times, want 1", n)
+	}
+	if n := f.count(http.MethodPost, "/vm/batch-1/resume"); n != 1 {
+		t.Errorf("resumed the new hostname %d times, want 1", n)
+	}
+	rs.stateMgr.mu.Lock()
+	hostname, stale := rs.stateMgr.vms["myapp"].hostname, rs.stateMgr.vms["myapp"].stale
+	rs.stateMgr.mu.Unlock()
+	if hostname != "batch-1" || stale {
+		t.Errorf("cached hostname %q, stale %v, want batch-1 and fresh", hostname, stale)
+	}
+}
+
+func TestNoWakeWhileDraining(t *testing.T) {
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h")
+
+	rs.stateMgr.drain(time.Second)
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("ensureRunning error = %v, want errShuttingDown", err)
+	}
+	if n := f.count(http.MethodPost, "/vm/apps-1/resume"); n != 0 {
+		t.Fatalf("resumed %d times while draining", n)
+	}
+}
+
+func TestVanishedVMMarkedStale(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("status 404 Not Found: no such VM"), true},
+		{errors.New("status 404 Not Found: "), true},
+		{errors.New("status 400 Bad Request: hostname not found in request"), false},
+		{errors.New(`app "myapp": not found`), false},
+		{nil, false},
+	} {
+		if got := isVMNotFound(tt.err); got != tt.want {
+			t.Errorf("isVMNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	f := newFakeSlicer(t)
+	f.setNodes(map[string]any{"hostname": "apps-1", "ip": "127.0.0.1", "status": "Running", "tags": []string{"myapp"}})
+	rs := newTestHandler(t, f, "idle_timeout 1h")
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Slicer no longer knows the VM under its cached hostname and answers
+	// the pause with a 404 whose body does not say "not found".
+	f.setNodes(map[string]any{"hostname": "apps-2", "ip": "127.0.0.1", "status": "Running", "tags": []string{"myapp"}})
+	if pauseApp(t.Context(), rs, "myapp", "manual", -1) {
+		t.Fatal("pause of a vanished VM reported success")
+	}
+	if !rs.stateMgr.isStale("myapp") {
+		t.Error("vanished VM not marked stale after a failed pause")
+	}
+}
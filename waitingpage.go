@@ -0,0 +1,67 @@
+package caddyrelightslicervm
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// waitingPageData is what a waiting_page template is rendered with.
+type waitingPageData struct {
+	// App is the app being woken.
+	App string
+	// RetryAfter is the Retry-After interval in seconds, for a
+	// <meta http-equiv="refresh"> tag.
+	RetryAfter int
+	// State is the X-Slicer-State value: waking, failed, cooldown or shed.
+	State string
+	// Message is the plain-text response that would otherwise be sent.
+	Message string
+}
+
+// loadWaitingPage parses the waiting page template from file, or from
+// inline when file is empty. It returns nil when neither is set.
+func loadWaitingPage(file, inline string) (*template.Template, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading waiting_page: %w", err)
+		}
+		inline = string(b)
+	} else if inline == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("waiting_page").Parse(inline)
+	if err != nil {
+		return nil, fmt.Errorf("parsing waiting_page: %w", err)
+	}
+	return tmpl, nil
+}
+
+// writeWaitingPage serves the waiting page with status, normally 503, and
+// Retry-After already set by the caller. It reports false, having written
+// nothing, when no page is configured or rendering fails, so the caller can
+// fall back to plain text.
+func (rs *SlicerVM) writeWaitingPage(w http.ResponseWriter, status int, data waitingPageData) bool {
+	if rs.waitingPage == nil {
+		return false
+	}
+
+	var buf bytes.Buffer
+	if err := rs.waitingPage.Execute(&buf, data); err != nil {
+		rs.logger.Error("rendering waiting page", zap.String("app", data.App), zap.Error(err))
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
@@ -0,0 +1,73 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// warmupPaths returns the warmup paths configured for app, matching the
+// full name first, then its first label.
+func (m *vmStateManager) warmupPaths(appName string) []string {
+	if paths, ok := m.warmups[appName]; ok {
+		return paths
+	}
+	return m.warmups[firstLabel(appName)]
+}
+
+// warmup issues the app's warmup requests against the freshly woken node at
+// ip, in order, before waiters are released. Failures are logged and do not
+// fail the wake; the whole sequence is bounded by deadline, the end of the
+// wake's timeout, so waiters are released before they give up on the wake.
+func (m *vmStateManager) warmup(appName, ip string, deadline time.Time) {
+	paths := m.warmupPaths(appName)
+	if len(paths) == 0 || ip == "" {
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(m.ctx, deadline)
+	defer cancel()
+
+	start := time.Now()
+	base := m.upstreamScheme + "://" + net.JoinHostPort(ip, strconv.Itoa(m.portFor(appName)))
+	for _, path := range paths {
+		if err := warmupRequest(ctx, m.upstreamClient, base+path); err != nil {
+			m.logger.Warn("warmup request failed",
+				zap.String("app", appName),
+				zap.String("path", path),
+				zap.Error(err),
+			)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+	m.logger.Debug("warmup finished",
+		zap.String("app", appName),
+		zap.Int("requests", len(paths)),
+		zap.Duration("took", time.Since(start)),
+	)
+}
+
+func warmupRequest(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package caddyrelightslicervm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWarmupRequests(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			http.Error(w, "not ready", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(app.Close)
+	port := app.URL[strings.LastIndex(app.URL, ":")+1:]
+
+	f := newFakeSlicer(t)
+	rs := newTestHandler(t, f, "idle_timeout 1h\napp_port "+port+"\nwarmup_requests myapp /fail /warm?cache=1 /prime")
+
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", 5*time.Second); err != nil {
+		t.Fatalf("ensureRunning = %v; a failed warmup request must not fail the wake", err)
+	}
+
+	// Warmups finish before the wake is reported done.
+	mu.Lock()
+	got := slices.Clone(paths)
+	mu.Unlock()
+	if want := []string{"/fail", "/warm?cache=1", "/prime"}; !slices.Equal(got, want) {
+		t.Errorf("warmup requests = %q, want %q in order", got, want)
+	}
+
+	// A VM that is already running is not warmed up again.
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 3 {
+		t.Errorf("%d warmup requests after a second call, want 3", len(paths))
+	}
+}
+
+func TestWarmupWithinWakeTimeout(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(app.Close)
+	port := app.URL[strings.LastIndex(app.URL, ":")+1:]
+
+	f := newFakeSlicer(t)
+	f.onResume = func(string) (int, string) {
+		time.Sleep(500 * time.Millisecond)
+		return 0, ""
+	}
+	rs := newTestHandler(t, f, "idle_timeout 1h\nwake_timeout 1s\napp_port "+port+"\nwarmup_requests myapp /slow")
+
+	// The resume takes half the wake timeout, so the hanging warmup only
+	// gets the other half rather than a full timeout of its own.
+	start := time.Now()
+	if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 1300*time.Millisecond {
+		t.Errorf("wake took %v, want it done within wake_timeout 1s", took)
+	}
+}
@@ -0,0 +1,218 @@
+package caddyrelightslicervm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WarmWindow keeps an app running during recurring time windows, e.g.
+// business hours, and lets it idle normally outside them.
+type WarmWindow struct {
+	// App is the app name (tag or hostname) to keep warm.
+	App string `json:"app"`
+
+	// Days are the days the window opens on: "*" for every day, or a
+	// comma-separated list of day names and ranges such as "mon-fri" or
+	// "sat,sun".
+	Days string `json:"days"`
+
+	// From and To are the window's local start and end times as HH:MM.
+	// To may be "24:00", or earlier than From for a window that runs past
+	// midnight into the next day.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Timezone is the IANA time zone the window is in, e.g.
+	// "Europe/London". Default: the server's local time zone.
+	Timezone string `json:"timezone,omitempty"`
+
+	days     uint8 // bit per weekday, Sunday is bit 0
+	from, to int   // minutes since midnight
+	loc      *time.Location
+}
+
+// parse validates the window and fills in its parsed fields.
+func (w *WarmWindow) parse() error {
+	var err error
+	if w.days, err = parseWeekdays(w.Days); err != nil {
+		return err
+	}
+	if w.from, err = parseClock(w.From); err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	if w.to, err = parseClock(w.To); err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+	if w.from == w.to || w.from == 24*60 {
+		return fmt.Errorf("window %s-%s is empty", w.From, w.To)
+	}
+	w.loc = time.Local
+	if w.Timezone != "" {
+		if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("timezone: %w", err)
+		}
+	}
+	return nil
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWeekdays parses "*" or a list of day names and ranges into a bitmask.
+func parseWeekdays(spec string) (uint8, error) {
+	if spec == "*" {
+		return 1<<7 - 1, nil
+	}
+	var days uint8
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		start, ok := weekdayNames[from]
+		if !ok {
+			return 0, fmt.Errorf("invalid day %q", from)
+		}
+		end := start
+		if isRange {
+			if end, ok = weekdayNames[to]; !ok {
+				return 0, fmt.Errorf("invalid day %q", to)
+			}
+		}
+		// Ranges may wrap around the week, e.g. "fri-mon".
+		for d := start; ; d = (d + 1) % 7 {
+			days |= 1 << d
+			if d == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses HH:MM, including 24:00, into minutes since midnight.
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// end returns when the window containing t closes, or false if t is
+// outside every occurrence of the window.
+func (w *WarmWindow) end(t time.Time) (time.Time, bool) {
+	t = t.In(w.loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := w.days&(1<<t.Weekday()) != 0
+	yesterday := w.days&(1<<((t.Weekday()+6)%7)) != 0
+
+	at := func(day time.Time, minutes int) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), 0, minutes, 0, 0, w.loc)
+	}
+	switch {
+	case w.from < w.to:
+		if today && minute >= w.from && minute < w.to {
+			return at(midnight, w.to), true
+		}
+	case today && minute >= w.from:
+		// Overnight window opened today.
+		return at(midnight.AddDate(0, 0, 1), w.to), true
+	case yesterday && minute < w.to:
+		// Overnight window opened yesterday.
+		return at(midnight, w.to), true
+	}
+	return time.Time{}, false
+}
+
+// warmWindowInterval is how often open warm windows are enforced.
+const warmWindowInterval = time.Minute
+
+var (
+	warmWindowMu      sync.Mutex
+	warmWindowCancels = make(map[*SlicerVM]context.CancelFunc)
+)
+
+// startWarmWindows launches a background goroutine that keeps apps running
+// during their warm windows. It is a no-op when none are configured.
+func startWarmWindows(rs *SlicerVM) {
+	if len(rs.WarmWindows) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	warmWindowMu.Lock()
+	warmWindowCancels[rs] = cancel
+	warmWindowMu.Unlock()
+
+	go runWarmWindows(ctx, rs)
+}
+
+// stopWarmWindows cancels the warm window goroutine for this module instance.
+func stopWarmWindows(rs *SlicerVM) {
+	warmWindowMu.Lock()
+	cancel, ok := warmWindowCancels[rs]
+	if ok {
+		delete(warmWindowCancels, rs)
+	}
+	warmWindowMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+func runWarmWindows(ctx context.Context, rs *SlicerVM) {
+	defer func() {
+		if r := recover(); r != nil {
+			rs.logger.Error("warm windows panic recovered", zap.Any("panic", r))
+		}
+	}()
+
+	rs.logger.Info("warm windows started", zap.Int("windows", len(rs.WarmWindows)))
+
+	ticker := time.NewTicker(warmWindowInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		for _, w := range rs.WarmWindows {
+			if end, open := w.end(now); open && !rs.maintenance.Load() {
+				go keepWarm(ctx, rs, w.App, end)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			rs.logger.Info("warm windows stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keepWarm makes sure app is running and holds it warm until end, when it
+// goes back to idling normally.
+func keepWarm(ctx context.Context, rs *SlicerVM, app string, end time.Time) {
+	if _, ok := rs.appMaintenance(ctx, app); ok {
+		return
+	}
+	timeout := time.Duration(rs.WakeTimeout)
+	wakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if _, err := rs.stateMgr.ensureRunning(wakeCtx, app, timeout); err != nil {
+		rs.logger.Error("warm window wake failed", zap.String("app", app), zap.Error(err))
+		return
+	}
+	rs.stateMgr.keepWarmUntil(app, end)
+}
@@ -2,6 +2,8 @@ package caddyrelightslicervm
 
 import (
 	"context"
+	"errors"
+	"math/rand/v2"
 	"sync"
 	"time"
 
@@ -48,52 +50,258 @@ func runIdleWatcher(ctx context.Context, rs *SlicerVM) {
 
 	interval := time.Duration(rs.WatchInterval)
 	idleTimeout := time.Duration(rs.IdleTimeout)
+	window := time.Duration(rs.PauseCoalesceWindow)
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	// coalesceSince is when idle apps were first found since the last
+	// batch of pauses.
+	var coalesceSince time.Time
+
+	timer := time.NewTimer(jitter(interval, rs.WatchJitter))
+	defer timer.Stop()
 
 	rs.logger.Info("idle watcher started",
 		zap.Duration("interval", interval),
 		zap.Duration("idle_timeout", idleTimeout),
 	)
+	rs.stateMgr.checkHealth(ctx)
 
 	for {
 		select {
 		case <-ctx.Done():
 			rs.logger.Info("idle watcher stopped")
 			return
-		case <-ticker.C:
-			pauseIdleVMs(ctx, rs, idleTimeout)
+		case <-timer.C:
+			timer.Reset(jitter(interval, rs.WatchJitter))
+			rs.stateMgr.checkHealth(ctx)
+			if rs.maintenance.Load() {
+				continue
+			}
+			idle := rs.stateMgr.idleApps(idleTimeout, rs.IdleConfirmations)
+			switch {
+			case len(idle) == 0:
+				coalesceSince = time.Time{}
+			case window > 0 && coalesceSince.IsZero():
+				coalesceSince = time.Now()
+				rs.logger.Debug("coalescing idle pauses", zap.Int("apps", len(idle)), zap.Duration("window", window))
+			case window > 0 && time.Since(coalesceSince) < window:
+			default:
+				coalesceSince = time.Time{}
+				pauseIdleVMs(ctx, rs, rs.stateMgr.idleNodes(idle, rs.TargetRunning))
+			}
+			if rs.DeepIdleTimeout > 0 {
+				suspendDeepIdleVMs(ctx, rs, time.Duration(rs.DeepIdleTimeout))
+			}
+			if rs.MaxRunningLifetime > 0 {
+				recycleVMs(ctx, rs, time.Duration(rs.MaxRunningLifetime))
+			}
+			for group, n := range rs.stateMgr.runningVMs() {
+				slicerMetrics.runningVMs.WithLabelValues(group).Set(float64(n))
+			}
+			for group, statuses := range rs.stateMgr.vmsByStatus() {
+				for status, n := range statuses {
+					slicerMetrics.vms.WithLabelValues(group, status.String()).Set(float64(n))
+				}
+			}
+			rs.persistState()
 		}
 	}
 }
 
-func pauseIdleVMs(ctx context.Context, rs *SlicerVM, idleTimeout time.Duration) {
-	idle := rs.stateMgr.idleApps(idleTimeout)
-	for _, appName := range idle {
-		hostname := rs.stateMgr.getHostname(appName)
-		if hostname == "" {
+// jitter returns interval randomly adjusted by up to ±fraction of itself,
+// so handlers started together do not sweep, and pause, in lockstep. A
+// fraction of zero or less returns interval unchanged.
+func jitter(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return interval
+	}
+	spread := time.Duration(float64(interval) * fraction)
+	if spread <= 0 {
+		return interval
+	}
+	return interval - spread + rand.N(2*spread+1)
+}
+
+// pauseIdleVMs pauses the idle nodes picked by idleNodes. Slicer has no
+// batch pause, so each node is paused individually, pause_concurrency at a
+// time so one slow pause does not hold up the rest. Each node is checked to
+// still be idle when its pause starts, so a request that arrived since
+// idleApps ran is not cut off.
+func pauseIdleVMs(ctx context.Context, rs *SlicerVM, idle []appNode) {
+	sem := make(chan struct{}, rs.PauseConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, n := range idle {
+		// select picks at random when both are ready, so check ctx first
+		// to stop promptly once the watcher is cancelled.
+		if ctx.Err() != nil {
+			return
+		}
+		if dryRun(rs, n.app, n.hostname, "idle") {
 			continue
 		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		wg.Add(1)
+		go func(n appNode) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			pauseVM(ctx, rs, n.app, n.hostname, "idle", time.Duration(rs.IdleTimeout))
+		}(n)
+	}
+}
+
+// suspendDeepIdleVMs suspends to disk the VMs that have stayed paused for
+// longer than timeout, at the same bounded rate as pauses.
+func suspendDeepIdleVMs(ctx context.Context, rs *SlicerVM, timeout time.Duration) {
+	sem := make(chan struct{}, rs.PauseConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for hostname, appName := range rs.stateMgr.deepIdleNodes(timeout) {
+		if ctx.Err() != nil {
+			return
+		}
+		if dryRun(rs, appName, hostname, "deep idle") {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		wg.Add(1)
+		go func(appName, hostname string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sleepVM(ctx, rs, appName, hostname, "deep idle", true, 0)
+		}(appName, hostname)
+	}
+}
+
+// dryRun logs, with watch_dry_run, the pause the watcher would make and
+// reports true so the caller skips it.
+func dryRun(rs *SlicerVM, appName, hostname, reason string) bool {
+	if !rs.WatchDryRun {
+		return false
+	}
+	rs.logger.Info("dry run: would pause VM",
+		zap.String("app", appName),
+		zap.String("hostname", hostname),
+		zap.String("reason", reason),
+	)
+	return true
+}
+
+// recycleVMs pauses VMs that have been running for longer than lifetime, so
+// the next request gets a fresh resume. It is meant to contain slow leaks in
+// long-running guest apps, and runs regardless of activity.
+func recycleVMs(ctx context.Context, rs *SlicerVM, lifetime time.Duration) {
+	for _, appName := range rs.stateMgr.expiredApps(lifetime) {
+		if ctx.Err() != nil {
+			return
+		}
+		for _, hostname := range rs.stateMgr.runningNodes(appName) {
+			if ctx.Err() != nil {
+				return
+			}
+			if dryRun(rs, appName, hostname, "max running lifetime") {
+				continue
+			}
+			if pauseVM(ctx, rs, appName, hostname, "max running lifetime", 0) {
+				slicerMetrics.recycles.WithLabelValues(rs.stateMgr.appHostGroup(appName)).Inc()
+			}
+		}
+	}
+}
+
+// pauseApp pauses every running node of appName, subject to minIdle as in
+// sleepVM. It reports whether all of them were paused.
+func pauseApp(ctx context.Context, rs *SlicerVM, appName, reason string, minIdle time.Duration) bool {
+	ok := true
+	for _, hostname := range rs.stateMgr.runningNodes(appName) {
+		ok = pauseVM(ctx, rs, appName, hostname, reason, minIdle) && ok
+	}
+	return ok
+}
 
-		rs.logger.Info("pausing idle VM",
+// pauseVM pauses a single VM, or suspends it with pause_mode suspend,
+// bounding the call by PauseTimeout. It reports whether the VM was paused.
+func pauseVM(ctx context.Context, rs *SlicerVM, appName, hostname, reason string, minIdle time.Duration) bool {
+	return sleepVM(ctx, rs, appName, hostname, reason, rs.PauseMode == pauseModeSuspend, minIdle)
+}
+
+// sleepVM pauses hostname, or suspends it to disk if suspend is set. The
+// node is claimed with beginPause for the length of the call, so requests
+// for it wait for the pause instead of racing it; minIdle is passed on, and
+// the pause is skipped if the claim is refused.
+func sleepVM(ctx context.Context, rs *SlicerVM, appName, hostname, reason string, suspend bool, minIdle time.Duration) bool {
+	if rs.maintenance.Load() {
+		rs.logger.Debug("maintenance mode, skipping pause",
 			zap.String("app", appName),
 			zap.String("hostname", hostname),
+			zap.String("reason", reason),
 		)
+		return false
+	}
+	if !rs.stateMgr.beginPause(hostname, minIdle) {
+		rs.logger.Debug("VM in use, skipping pause",
+			zap.String("app", appName),
+			zap.String("hostname", hostname),
+			zap.String("reason", reason),
+		)
+		return false
+	}
+	defer rs.stateMgr.endPause(hostname)
+
+	pause := rs.client.PauseVM
+	if suspend {
+		pause = rs.client.SuspendVM
+	}
+	rs.logger.Info("pausing VM",
+		zap.String("app", appName),
+		zap.String("hostname", hostname),
+		zap.String("reason", reason),
+		zap.Bool("suspend", suspend),
+	)
 
-		if err := rs.client.PauseVM(ctx, hostname); err != nil {
-			rs.logger.Error("failed to pause VM",
+	timeout := time.Duration(rs.PauseTimeout)
+	pauseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := pause(pauseCtx, hostname); err != nil {
+		if errors.Is(pauseCtx.Err(), context.DeadlineExceeded) {
+			rs.logger.Warn("pause VM timed out",
 				zap.String("app", appName),
 				zap.String("hostname", hostname),
-				zap.Error(err),
+				zap.Duration("timeout", timeout),
 			)
-			continue
+			return false
 		}
-
-		rs.stateMgr.markPaused(appName)
-		rs.logger.Info("VM paused successfully",
+		rs.logger.Error("failed to pause VM",
 			zap.String("app", appName),
 			zap.String("hostname", hostname),
+			zap.Error(err),
 		)
+		if isVMNotFound(err) {
+			rs.stateMgr.markStale(appName)
+		}
+		return false
 	}
+
+	rs.stateMgr.markPaused(appName, hostname, reason)
+	if suspend {
+		rs.stateMgr.markSuspended(hostname, reason)
+	}
+	rs.stateMgr.emit(eventVMPaused, appName, hostname, map[string]any{"reason": reason, "suspended": suspend})
+	rs.logger.Info("VM paused successfully",
+		zap.String("app", appName),
+		zap.String("hostname", hostname),
+	)
+	return true
 }
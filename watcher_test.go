@@ -0,0 +1,117 @@
+package caddyrelightslicervm
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestPauseIdleVMsConcurrency(t *testing.T) {
+	const apps, limit = 8, 2
+
+	f := newFakeSlicer(t)
+	f.setNodes()
+	var mu sync.Mutex
+	var inFlight, peak int
+	f.onPause = func(string) (int, string) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return 0, ""
+	}
+	var idle []string
+	for i := 1; i <= apps; i++ {
+		app := fmt.Sprintf("app%d", i)
+		f.addNode(fmt.Sprintf("apps-%d", i), fmt.Sprintf("127.0.0.%d", i), "Running", app)
+		idle = append(idle, app)
+	}
+	rs := newTestHandler(t, f, fmt.Sprintf("idle_timeout 1h\npause_concurrency %d", limit))
+	for _, app := range idle {
+		if _, err := rs.stateMgr.ensureRunning(t.Context(), app, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rs.IdleTimeout = caddy.Duration(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	pauseIdleVMs(t.Context(), rs, rs.stateMgr.idleNodes(idle, 0))
+
+	for i := 1; i <= apps; i++ {
+		if n := f.count(http.MethodPost, fmt.Sprintf("/vm/apps-%d/pause", i)); n != 1 {
+			t.Errorf("apps-%d paused %d times, want 1", i, n)
+		}
+	}
+	if peak > limit {
+		t.Errorf("%d pauses ran at once, want at most %d", peak, limit)
+	}
+	if peak < limit {
+		t.Errorf("at most %d pauses ran at once, want %d", peak, limit)
+	}
+}
+
+func TestTargetRunning(t *testing.T) {
+	t.Run("replicas", func(t *testing.T) {
+		f := newFakeSlicer(t)
+		f.setNodes()
+		f.addNode("apps-1", "127.0.0.1", "Running", "myapp")
+		f.addNode("apps-2", "127.0.0.2", "Running", "myapp")
+		rs := newTestHandler(t, f, "idle_timeout 1h\nmin_replicas 2\ntarget_running 1")
+		if _, err := rs.stateMgr.ensureRunning(t.Context(), "myapp", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		rs.IdleTimeout = caddy.Duration(time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		// The only app is idle, but pausing both its replicas would leave
+		// none running.
+		pauseIdleVMs(t.Context(), rs, rs.stateMgr.idleNodes([]string{"myapp"}, rs.TargetRunning))
+
+		paused := f.count(http.MethodPost, "/vm/apps-1/pause") + f.count(http.MethodPost, "/vm/apps-2/pause")
+		if paused != 1 {
+			t.Fatalf("paused %d replicas, want 1", paused)
+		}
+		if n := len(rs.stateMgr.runningNodes("myapp")); n != 1 {
+			t.Errorf("%d replicas running, want 1", n)
+		}
+	})
+
+	t.Run("per host group", func(t *testing.T) {
+		f := newFakeSlicer(t)
+		f.setNodes()
+		f.addNode("apps-1", "127.0.0.1", "Running", "myapp")
+		f.addNode("apps-2", "127.0.0.2", "Running", "other")
+		f.addNode("batch-1", "127.0.0.3", "Running", "job")
+		rs := newTestHandler(t, f, "idle_timeout 1h\nhost_group batch .batch.example.com\ntarget_running 1")
+		idle := []string{"myapp", "other", "job.batch.example.com"}
+		for _, app := range idle {
+			if _, err := rs.stateMgr.ensureRunning(t.Context(), app, time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rs.IdleTimeout = caddy.Duration(time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		// The apps group is one over its target; the batch group is at it.
+		pauseIdleVMs(t.Context(), rs, rs.stateMgr.idleNodes(idle, rs.TargetRunning))
+
+		if n := f.count(http.MethodPost, "/vm/batch-1/pause"); n != 0 {
+			t.Errorf("paused the batch group's only VM %d times", n)
+		}
+		// myapp was woken first, so it is the least recently used.
+		if n := f.count(http.MethodPost, "/vm/apps-1/pause"); n != 1 {
+			t.Errorf("apps-1 paused %d times, want 1", n)
+		}
+		if n := f.count(http.MethodPost, "/vm/apps-2/pause"); n != 0 {
+			t.Errorf("apps-2 paused %d times, want 0", n)
+		}
+	})
+}